@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// length of each MAC of an authenticator, truncated HMAC-SHA256
+const macLength = 16
+
+// macHeaders are the messages that may be sent with an authenticator instead of a signature,
+// each enabled by the mac<Header> key of system config. Messages that end up in certificates
+// for other replicas (pre-prepares, prepares, checkpoints, view changes) stay signed,
+// an authenticator only convinces the replicas it is addressed to
+var macHeaders = map[HeaderMsg]bool{
+	hCommit: true,
+}
+
+// the collector puts commits in certificates, they stay signed in collector mode
+func macEnabled(header HeaderMsg) bool {
+	return macHeaders[header] && SystemConfig["mac"+string(header)] == 1 && !collectorMode()
+}
+
+// deriveMacKey turns the shared secret of a handshake into the session key of two replicas
+func deriveMacKey(shared []byte, a int, b int) []byte {
+	if a > b {
+		a, b = b, a
+	}
+	ids := make([]byte, 16)
+	binary.BigEndian.PutUint64(ids[:8], uint64(a))
+	binary.BigEndian.PutUint64(ids[8:], uint64(b))
+	hash := sha256.New()
+	hash.Write([]byte("pbft-mac"))
+	hash.Write(shared)
+	hash.Write(ids)
+	return hash.Sum(nil)
+}
+
+func computeMac(key []byte, digest []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(digest)
+	return mac.Sum(nil)[:macLength]
+}
+
+// authenticate signs msg, or builds its authenticator when enabled for header:
+// one MAC per replica in the order of knownNodes
+func (node *Node) authenticate(header HeaderMsg, msg interface{}) ([]byte, error) {
+	if !macEnabled(header) {
+		return node.signMessage(msg)
+	}
+	digest := generateDigest(msg)
+	auth := make([]byte, macLength*len(node.knownNodes))
+	for i, knownNode := range node.knownNodes {
+		if knownNode.nodeID == node.nodeID {
+			continue
+		}
+		key := node.hub.macKey(knownNode.nodeID)
+		if key == nil {
+			// no session with this replica, it gets an empty MAC it cannot verify
+			Logger.Warnf("No session key with replica %d, it cannot verify this %s", knownNode.nodeID, header)
+			continue
+		}
+		copy(auth[i*macLength:], computeMac(key, digest))
+	}
+	return auth, nil
+}
+
+// verifyAuthenticator checks the MAC addressed to this replica in the authenticator of sender
+func (node *Node) verifyAuthenticator(sender int, msg interface{}, auth []byte) error {
+	if len(auth) != macLength*len(node.knownNodes) {
+		return fmt.Errorf("invalid authenticator length %d", len(auth))
+	}
+	key := node.hub.macKey(sender)
+	if key == nil {
+		return fmt.Errorf("no session key")
+	}
+	for i, knownNode := range node.knownNodes {
+		if knownNode.nodeID != node.nodeID {
+			continue
+		}
+		expected := computeMac(key, generateDigest(msg))
+		if !hmac.Equal(expected, auth[i*macLength:(i+1)*macLength]) {
+			return fmt.Errorf("invalid MAC")
+		}
+		return nil
+	}
+	return fmt.Errorf("replica not in the authenticator")
+}
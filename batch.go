@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// batchConfig bounds the batches the primary orders, from system config
+type batchConfig struct {
+	maxCount int
+	maxBytes int
+	maxDelay time.Duration
+}
+
+func newBatchConfig() batchConfig {
+	config := batchConfig{
+		SystemConfig["batchSize"],
+		SystemConfig["batchBytes"],
+		time.Duration(SystemConfig["batchDelay"]) * time.Millisecond,
+	}
+	if config.maxCount <= 0 {
+		config.maxCount = 1
+	}
+	return config
+}
+
+// batchDigest identifies a batch, it covers every request and its client signature,
+// it hashes the binary encoding whatever codec the messages use
+func batchDigest(requests []SignedRequestMsg) string {
+	e := &msgEncoder{}
+	encodeRequests(e, requests)
+	hash := sha256.Sum256(e.buf)
+	return hex.EncodeToString(hash[:])
+}
+
+// addToBatch adds a request to the batch the primary is filling,
+// the batch is proposed once it is full or its delay expired
+func (node *Node) addToBatch(request SignedRequestMsg) {
+	size := len(request.Request.CRequest.Message) + len(request.Request.Operation)
+	node.mutex.Lock()
+	if len(node.batch) > 0 && node.batchBytes+size > node.batchConfig.maxBytes && node.batchConfig.maxBytes > 0 {
+		// the request does not fit, order what we have first
+		batch := node.takeBatch()
+		node.mutex.Unlock()
+		node.propose(batch)
+		node.mutex.Lock()
+	}
+	node.batch = append(node.batch, request)
+	node.batchBytes += size
+	full := len(node.batch) >= node.batchConfig.maxCount ||
+		(node.batchConfig.maxBytes > 0 && node.batchBytes >= node.batchConfig.maxBytes)
+	if !full {
+		if node.batchTimer == nil {
+			node.batchTimerID++
+			timerID := node.batchTimerID
+			node.batchTimer = time.AfterFunc(node.batchConfig.maxDelay, func() {
+				node.batchQueue <- timerID
+			})
+		}
+		node.mutex.Unlock()
+		return
+	}
+	batch := node.takeBatch()
+	node.mutex.Unlock()
+	node.propose(batch)
+}
+
+// flushBatch proposes the batch being filled without waiting for it to be full
+func (node *Node) flushBatch() {
+	node.mutex.Lock()
+	batch := node.takeBatch()
+	node.mutex.Unlock()
+	if len(batch) > 0 {
+		node.propose(batch)
+	}
+}
+
+func (node *Node) handleBatchTimeout(timerID int) {
+	node.mutex.Lock()
+	if node.batchTimer == nil || timerID != node.batchTimerID {
+		node.mutex.Unlock()
+		return
+	}
+	node.mutex.Unlock()
+	node.flushBatch()
+}
+
+// must be called with node.mutex held
+func (node *Node) takeBatch() []SignedRequestMsg {
+	batch := node.batch
+	node.batch = nil
+	node.batchBytes = 0
+	if node.batchTimer != nil {
+		node.batchTimer.Stop()
+		node.batchTimer = nil
+	}
+	return batch
+}
+
+// storeBatch keeps the requests of a batch so it can be executed once committed, every
+// batch holds its own copy so collecting the garbage of one leaves the others whole,
+// must be called with node.mutex held
+func (node *Node) storeBatch(digest string, requests []SignedRequestMsg) {
+	node.batchPool[digest] = requests
+}
+
+// must be called with node.mutex held
+func (node *Node) batchRequests(digest string) []SignedRequestMsg {
+	return node.batchPool[digest]
+}
+
+// verifyBatch checks a batch the way the primary checked each of its requests
+func (node *Node) verifyBatch(digest string, requests []SignedRequestMsg) error {
+	if len(requests) == 0 {
+		return fmt.Errorf("empty batch")
+	}
+	if batchDigest(requests) != digest {
+		return fmt.Errorf("batch digest mismatch")
+	}
+	seen := make(map[string]bool)
+	for i := range requests {
+		request := &requests[i].Request
+		if !verifyDigest(request.CRequest.Message, request.CRequest.Digest) {
+			return fmt.Errorf("invalid digest of request %d", i)
+		}
+		if seen[requestKey(request)] {
+			return fmt.Errorf("request %d appears twice", i)
+		}
+		seen[requestKey(request)] = true
+		if isSystemRequest(request) {
+			// ordered by the primary for the replicas, checked when executed
+			continue
+		}
+		err := node.verifyRequestSignature(request, requests[i].Signature)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
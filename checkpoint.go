@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"sr-bft/state"
+)
+
+// the high watermark is this many checkpoint periods above the low watermark
+const watermarkWindow = 2
+
+// must be called with node.mutex held
+func (node *Node) highWatermark() int {
+	return node.stableSeqID + watermarkWindow*node.period
+}
+
+func (node *Node) inWatermarks(seq int) bool {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return seq > node.stableSeqID && seq <= node.highWatermark()
+}
+
+// takeCheckpoint snapshots the application every period requests,
+// must be called with node.mutex held
+func (node *Node) takeCheckpoint() *CheckpointMsg {
+	if (node.lastExecuted+1)%node.period != 0 {
+		return nil
+	}
+	snapshot := node.snapshot()
+	node.checkpointSnapshots[node.lastExecuted] = snapshot
+	return &CheckpointMsg{
+		node.lastExecuted,
+		snapshotDigest(snapshot),
+		node.nodeID,
+	}
+}
+
+func (node *Node) sendCheckpoint(checkpointMsg CheckpointMsg) {
+	sig, err := node.signMessage(checkpointMsg)
+	if err != nil {
+		Logger.Error("Sign checkpoint msg failed:%v", err)
+		return
+	}
+	node.mutex.Lock()
+	node.logCheckpoint(&SignedCheckpointMsg{checkpointMsg, sig})
+	node.mutex.Unlock()
+	logBroadcastMsg(hCheckpoint, checkpointMsg)
+	node.broadcast(ComposeMsg(hCheckpoint, checkpointMsg, sig))
+	node.checkStableCheckpoint(checkpointMsg.SequenceID)
+}
+
+func (node *Node) handleCheckpoint(payload []byte, sig []byte) {
+	var checkpointMsg CheckpointMsg
+	err := json.Unmarshal(payload, &checkpointMsg)
+	if err != nil {
+		Logger.Error("Error happened in handle Checkpoint:%v", err)
+		return
+	}
+	logHandleMsg(hCheckpoint, checkpointMsg, checkpointMsg.NodeID)
+	if (checkpointMsg.SequenceID+1)%node.period != 0 {
+		node.rejectReplicaMsg(hCheckpoint, checkpointMsg.NodeID, fmt.Sprintf("sequence %d is not a checkpoint", checkpointMsg.SequenceID))
+		return
+	}
+	node.mutex.Lock()
+	if checkpointMsg.SequenceID <= node.stableSeqID {
+		node.mutex.Unlock()
+		return
+	}
+	if checkpointMsg.SequenceID > node.highWatermark() && !node.keepAheadCheckpoint(&checkpointMsg) {
+		node.mutex.Unlock()
+		return
+	}
+	node.logCheckpoint(&SignedCheckpointMsg{checkpointMsg, sig})
+	node.mutex.Unlock()
+	node.checkStableCheckpoint(checkpointMsg.SequenceID)
+}
+
+// keepAheadCheckpoint makes room for a checkpoint above the high watermark, only the
+// latest one of every replica is kept there: a replica that fell behind still learns
+// where the others are, and a faulty replica cannot fill checkpointLog,
+// must be called with node.mutex held
+func (node *Node) keepAheadCheckpoint(checkpoint *CheckpointMsg) bool {
+	for seq, msgs := range node.msgLog.checkpointLog {
+		if _, ok := msgs[checkpoint.NodeID]; !ok || seq <= node.highWatermark() {
+			continue
+		}
+		if seq >= checkpoint.SequenceID {
+			return false
+		}
+		delete(msgs, checkpoint.NodeID)
+		if len(msgs) == 0 {
+			delete(node.msgLog.checkpointLog, seq)
+		}
+	}
+	return true
+}
+
+// must be called with node.mutex held
+func (node *Node) logCheckpoint(msg *SignedCheckpointMsg) {
+	seq := msg.Checkpoint.SequenceID
+	if node.msgLog.checkpointLog[seq] == nil {
+		node.msgLog.checkpointLog[seq] = make(map[int]*SignedCheckpointMsg)
+	}
+	node.msgLog.checkpointLog[seq][msg.Checkpoint.NodeID] = msg
+}
+
+// checkStableCheckpoint makes the checkpoint at seq stable once n-f replicas agree on its digest
+func (node *Node) checkStableCheckpoint(seq int) {
+	node.mutex.Lock()
+	if seq <= node.stableSeqID {
+		node.mutex.Unlock()
+		return
+	}
+	byDigest := make(map[string][]SignedCheckpointMsg)
+	for _, msg := range node.msgLog.checkpointLog[seq] {
+		byDigest[msg.Checkpoint.Digest] = append(byDigest[msg.Checkpoint.Digest], *msg)
+	}
+	var proof []SignedCheckpointMsg
+	for _, msgs := range byDigest {
+		if len(msgs) >= node.countNeedReceiveMsgAmount() {
+			proof = msgs
+		}
+	}
+	if proof == nil {
+		node.mutex.Unlock()
+		return
+	}
+	sort.Slice(proof, func(i, j int) bool {
+		return proof[i].Checkpoint.NodeID < proof[j].Checkpoint.NodeID
+	})
+	node.stableSeqID = seq
+	node.stableProof = proof
+	node.stableSnapshot = node.checkpointSnapshots[seq]
+	node.collectGarbage()
+	lastExecuted := node.lastExecuted
+	queue := node.proposalQueue
+	node.proposalQueue = nil
+	isPrimary := node.findPrimaryNode() == node.nodeID && !node.viewChanging
+	node.mutex.Unlock()
+
+	Logger.Infof("Checkpoint %d is stable", seq)
+	if lastExecuted < seq {
+		Logger.Warnf("Replica is behind the stable checkpoint %d, executed up to %d", seq, lastExecuted)
+		node.requestStateTransfer()
+	} else {
+		node.persistCheckpoint()
+	}
+	if isPrimary {
+		// the window moved, order the requests that did not fit before
+		for _, batch := range queue {
+			node.propose(batch)
+		}
+		node.proposeWeights()
+	}
+}
+
+// collectGarbage drops every log entry at or below the stable checkpoint,
+// must be called with node.mutex held
+func (node *Node) collectGarbage() {
+	discard := func(digest string) {
+		delete(node.msgLog.preprepareLog, digest)
+		delete(node.msgLog.prepareLog, digest)
+		delete(node.msgLog.commitLog, digest)
+		delete(node.msgLog.replyLog, digest)
+		delete(node.msgLog.prePrepareMsgs, digest)
+		delete(node.msgLog.prepareMsgs, digest)
+		delete(node.msgLog.commitMsgs, digest)
+		delete(node.msgLog.commitCerts, digest)
+		delete(node.msgLog.fastCommits, digest)
+		delete(node.msgLog.prePrepareAt, digest)
+		delete(node.batchPool, digest)
+	}
+	for seq, digest := range node.executedSeqs {
+		if seq <= node.stableSeqID {
+			discard(digest)
+			delete(node.executedSeqs, seq)
+		}
+	}
+	for seq, digest := range node.executionQueue {
+		if seq <= node.stableSeqID {
+			discard(digest)
+			delete(node.executionQueue, seq)
+		}
+	}
+	// requests ordered below the checkpoint that this replica never executed
+	for digest, prePrepare := range node.msgLog.prePrepareMsgs {
+		if prePrepare.PrePrepare.SequenceID <= node.stableSeqID {
+			discard(digest)
+		}
+	}
+	for seq := range node.msgLog.checkpointLog {
+		if seq <= node.stableSeqID {
+			delete(node.msgLog.checkpointLog, seq)
+		}
+	}
+	for key := range node.deferredMsgs {
+		if key.seq <= node.stableSeqID {
+			delete(node.deferredMsgs, key)
+		}
+	}
+	for seq := range node.checkpointSnapshots {
+		if seq <= node.stableSeqID {
+			delete(node.checkpointSnapshots, seq)
+		}
+	}
+	// requests superseded by a later request of their client
+	for key, request := range node.requestPool {
+		if node.executed(&request.Request) {
+			delete(node.requestPool, key)
+		}
+	}
+	node.weightEpochs = node.pruneWeightEpochs(node.stableSeqID)
+}
+
+// persistCheckpoint writes the stable checkpoint to disk so a restarted replica can resume from it
+func (node *Node) persistCheckpoint() {
+	node.mutex.Lock()
+	if node.stableSnapshot == nil {
+		node.mutex.Unlock()
+		return
+	}
+	proof, err := json.Marshal(node.stableProof)
+	snapshot := &state.Snapshot{
+		SequenceID: node.stableSeqID,
+		Data:       node.stableSnapshot,
+		Proof:      proof,
+	}
+	node.mutex.Unlock()
+	if err == nil {
+		err = snapshot.SaveSnapshot(node.snapshotFile)
+	}
+	if err != nil {
+		Logger.Errorf("Saving checkpoint %d failed:%v", snapshot.SequenceID, err)
+	}
+}
+
+// loadCheckpoint resumes from the checkpoint persisted by a previous run
+func (node *Node) loadCheckpoint() {
+	var snapshot state.Snapshot
+	err := snapshot.LoadSnapshot(node.snapshotFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Logger.Errorf("Loading checkpoint failed:%v", err)
+		}
+		return
+	}
+	var proof []SignedCheckpointMsg
+	err = json.Unmarshal(snapshot.Proof, &proof)
+	if err != nil {
+		Logger.Errorf("Decoding checkpoint proof failed:%v", err)
+		return
+	}
+	digest, ok := node.verifyCheckpointProof(snapshot.SequenceID, proof)
+	if !ok || snapshotDigest(snapshot.Data) != digest {
+		Logger.Errorf("Saved checkpoint %d does not match its certificate", snapshot.SequenceID)
+		return
+	}
+	node.installSnapshot(&StateMsg{
+		snapshot.SequenceID,
+		proof,
+		snapshot.Data,
+		nil,
+		node.nodeID,
+	})
+}
+
+// must be called with node.mutex held
+func (node *Node) snapshot() []byte {
+	snapshot, err := node.app.Snapshot()
+	if err != nil {
+		Logger.Errorf("Application snapshot failed:%v", err)
+		return []byte{}
+	}
+	return node.wrapSnapshot(snapshot)
+}
+
+// must be called with node.mutex held
+func (node *Node) restoreSnapshot(snapshot []byte) {
+	err := node.app.Restore(node.unwrapSnapshot(snapshot))
+	if err != nil {
+		Logger.Errorf("Application restore failed:%v", err)
+	}
+}
+
+// replicaSnapshot carries the application state along with the last request of every
+// client, so a replica that catches up through a checkpoint drops the same retransmissions
+// as the others, and the weight schedule it needs to check the next pre-prepares
+type replicaSnapshot struct {
+	App     []byte                `json:"app"`
+	Clients map[int]*clientRecord `json:"clients"`
+	Weights []weightEpoch         `json:"weights,omitempty"`
+}
+
+// must be called with node.mutex held
+func (node *Node) wrapSnapshot(app []byte) []byte {
+	snapshot := replicaSnapshot{app, node.clientTable, node.snapshotWeights()}
+	wrapped, err := json.Marshal(snapshot)
+	if err != nil {
+		Logger.Errorf("Encoding the replica snapshot failed:%v", err)
+		return app
+	}
+	return wrapped
+}
+
+// must be called with node.mutex held
+func (node *Node) unwrapSnapshot(wrapped []byte) []byte {
+	var snapshot replicaSnapshot
+	if err := json.Unmarshal(wrapped, &snapshot); err != nil {
+		Logger.Errorf("Decoding the replica snapshot failed:%v", err)
+		return wrapped
+	}
+	node.clientTable = snapshot.Clients
+	if node.clientTable == nil {
+		node.clientTable = make(map[int]*clientRecord)
+	}
+	node.restoreWeights(snapshot.Weights)
+	return snapshot.App
+}
+
+func snapshotDigest(snapshot []byte) string {
+	hash := sha256.Sum256(snapshot)
+	return hex.EncodeToString(hash[:])
+}
+
+// verifyCheckpointProof checks n-f signed checkpoints from distinct replicas agreeing on seq,
+// it returns the agreed state digest
+func (node *Node) verifyCheckpointProof(seq int, proof []SignedCheckpointMsg) (string, bool) {
+	if len(proof) == 0 {
+		return "", false
+	}
+	digest := proof[0].Checkpoint.Digest
+	senders := make(map[int]bool)
+	for _, msg := range proof {
+		if msg.Checkpoint.SequenceID != seq || msg.Checkpoint.Digest != digest {
+			return "", false
+		}
+		pubkey := node.findNodePubkey(msg.Checkpoint.NodeID)
+		if pubkey == nil || !verifySignatrue(msg.Checkpoint, msg.Signature, pubkey) {
+			return "", false
+		}
+		senders[msg.Checkpoint.NodeID] = true
+	}
+	return digest, len(senders) >= node.countNeedReceiveMsgAmount()
+}
@@ -1,22 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"crypto/rand"
-	"encoding/json"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
-	"io"
+	mrand "math/rand"
 	"net"
 	"sync"
 	"time"
+
+	"sr-bft/state"
 )
 
 type Client struct {
 	nodeId      int
 	url         string
+	privateKey  Signer
 	knownNodes  []*NodeInfo
 	connections []*net.Conn
-	replyLog    map[int]*ReplyMsg
+	replyLog    map[int]map[int]*ReplyMsg // request timestamp -> replica -> reply
 	throuput    int
+	fastPath    int // requests of the current second committed on the fast path
 	mutex       sync.Mutex
 }
 
@@ -26,13 +32,15 @@ var ClientNode = ClientNodeInfo{
 	nil,
 }
 
-func NewClient() *Client {
+func NewClient(clientId int) *Client {
 	client := &Client{
-		ClientNode.nodeID,
+		clientId,
 		ClientNode.url,
+		ReadPrivateKey(clientKeysPath, clientId),
 		Replicas,
 		[]*net.Conn{},
-		make(map[int]*ReplyMsg),
+		make(map[int]map[int]*ReplyMsg),
+		0,
 		0,
 		sync.Mutex{},
 	}
@@ -48,9 +56,15 @@ func (c *Client) Start() {
 	for {
 		select {
 		case <-time.After(1 * time.Second):
-			fmt.Printf("Current Throughput: %d ops/s \n", c.throuput)
 			c.mutex.Lock()
+			if SystemConfig["fastPath"] == 1 {
+				fmt.Printf("Current Throughput: %d ops/s, %d on the fast path \n", c.throuput, c.fastPath)
+			} else {
+				fmt.Printf("Current Throughput: %d ops/s \n", c.throuput)
+			}
 			c.throuput = 0
+			c.fastPath = 0
+			c.pruneReplies()
 			c.mutex.Unlock()
 
 		}
@@ -64,30 +78,55 @@ func (c *Client) sendManyRequest() {
 	}
 }
 
-func (c *Client) handleRequest() {
-	req_size := 1024
-	msgb := make([]byte, req_size)
-	_, err := rand.Read(msgb)
+// key-value workload sent by the client
+const (
+	kvKeySpace  = 1000
+	kvValueSize = 512 // random bytes, hex encoded in the request
+)
+
+// nextOperation picks a random key-value operation
+func (c *Client) nextOperation() (string, state.KVCommand) {
+	cmd := state.KVCommand{
+		Key:   fmt.Sprintf("key-%d", mrand.Intn(kvKeySpace)),
+		Nonce: time.Now().UnixNano(),
+	}
+	value := make([]byte, kvValueSize)
+	_, err := rand.Read(value)
 	if err != nil {
 		fmt.Printf("Error in client Request : %v", err)
 		panic(err)
 	}
 
-	msg := string(msgb)
-	digest := string(generateDigest(msg))
+	switch mrand.Intn(4) {
+	case 0:
+		return state.OpGet, cmd
+	case 1:
+		cmd.Value = hex.EncodeToString(value)
+		return state.OpPut, cmd
+	case 2:
+		return state.OpDelete, cmd
+	default:
+		cmd.Value = hex.EncodeToString(value)
+		return state.OpCAS, cmd
+	}
+}
+
+func (c *Client) handleRequest() {
+	op, cmd := c.nextOperation()
+	msg := state.EncodeKVCommand(cmd)
+	digest := hex.EncodeToString(generateDigest(msg))
 
 	req := Request{
 		msg,
 		digest,
 	}
 	reqmsg := &RequestMsg{
-		"Operation",
-		int(time.Now().Unix()),
-		10,
+		op,
+		int(time.Now().UnixNano()), // also identifies the replies to this request
+		c.nodeId,
 		req,
 	}
-	sig := make([]byte, SignatureLength)
-	_, err = rand.Read(sig)
+	sig, err := c.signMessage(reqmsg)
 	if err != nil {
 		fmt.Printf("Error in client Signature : %v", err)
 		panic(err)
@@ -96,30 +135,97 @@ func (c *Client) handleRequest() {
 	c.sendRequest(req_msg)
 }
 
-func (c *Client) handleReply(payload []byte) {
+func (c *Client) handleReply(msg []byte) {
+	header, payload, sig := SplitMsg(msg)
+	if header != hReply {
+		return
+	}
 	var replyMsg ReplyMsg
-	fmt.Printf("Received reply: %s\n", payload)
-	err := json.Unmarshal(payload, &replyMsg)
+	err := decodeMsg(payload, &replyMsg)
 	if err != nil {
 		fmt.Printf("error happened:%v", err)
-		panic(err)
+		return
+	}
+	// a reply to another client must not count toward our requests
+	if replyMsg.ClientID != c.nodeId {
+		return
+	}
+	pubkey := c.findNodePubkey(replyMsg.NodeID)
+	if pubkey == nil || !verifySignatrue(replyMsg, sig, pubkey) {
+		fmt.Printf("Invalid reply signature from %d\n", replyMsg.NodeID)
+		return
 	}
 
 	c.mutex.Lock()
-	c.replyLog[replyMsg.NodeID] = &replyMsg
-	rlen := len(c.replyLog)
-	c.mutex.Unlock()
-	if rlen >= c.countNeedReceiveMsgAmount() {
+	defer c.mutex.Unlock()
+	if c.replyLog[replyMsg.Timestamp] == nil {
+		c.replyLog[replyMsg.Timestamp] = make(map[int]*ReplyMsg)
+	}
+	c.replyLog[replyMsg.Timestamp][replyMsg.NodeID] = &replyMsg
+	// f+1 matching replies include one from a correct replica,
+	// count the request once when the (f+1)th arrives
+	matching := 0
+	fast := 0
+	for _, reply := range c.replyLog[replyMsg.Timestamp] {
+		if reply.Result == replyMsg.Result {
+			matching++
+			if reply.FastPath {
+				fast++
+			}
+		}
+	}
+	if matching == c.countNeedReceiveMsgAmount() {
 		c.throuput++
+		// all of them committed on the fast path, a correct replica among them did
+		if fast == matching {
+			c.fastPath++
+		}
+	}
+}
+
+// pruneReplies forgets requests sent more than a minute ago, must be called with c.mutex held
+func (c *Client) pruneReplies() {
+	oldest := int(time.Now().Add(-time.Minute).UnixNano())
+	for timestamp := range c.replyLog {
+		if timestamp < oldest {
+			delete(c.replyLog, timestamp)
+		}
+	}
+}
+
+func (c *Client) findNodePubkey(nodeId int) Verifier {
+	for _, knownNode := range c.knownNodes {
+		if knownNode.nodeID == nodeId {
+			return knownNode.pubKey
+		}
 	}
+	return nil
 }
 
 func (c *Client) connectToNodes() {
 
 	var url string
+	var tlsConfig *tls.Config
+	if tlsEnabled(tlsClient) {
+		// replicas only accept the certificates of registered clients
+		cert, err := loadCertificate(clientKeysPath, c.nodeId, c.privateKey)
+		if err == nil {
+			tlsConfig, err = (&pinnedTlsConfigBuilder{cert, isReplicaKey}).BuildTlsConfig()
+		}
+		if err != nil {
+			fmt.Printf("Error in client loading TLS certificate: %v", err)
+			panic(err)
+		}
+	}
 	for _, node := range c.knownNodes {
 		url = fmt.Sprintf("%s:%d", node.ip, node.clientPort)
-		conn, err := net.Dial("tcp", url)
+		var conn net.Conn
+		var err error
+		if tlsConfig != nil {
+			conn, err = tls.Dial("tcp", url, tlsConfig)
+		} else {
+			conn, err = net.Dial("tcp", url)
+		}
 		if err != nil {
 			fmt.Printf("Error in client connecting to node: %v", err)
 			panic(err)
@@ -136,26 +242,25 @@ func (c *Client) pollConnections() {
 }
 
 func (c *Client) pollConnection(co *net.Conn) {
-	//var buf []byte
+	reader := bufio.NewReader(*co)
 	for {
-		//_, err := (*co).Read(buf)
-		buf, err := io.ReadAll(*co)
+		msg, err := ReadFrame(reader)
 		if err != nil {
 			fmt.Printf("Error in client reading msg: %v", err)
 			panic(err)
 		}
-		c.handleReply(buf)
+		c.handleReply(msg)
 	}
 }
 
 func (c *Client) signMessage(msg interface{}) ([]byte, error) {
-	// TODO
-	return nil, nil
+	return signMessage(msg, c.privateKey)
 }
 
 func (c *Client) sendRequest(msg []byte) {
+	frame := EncodeFrame(msg)
 	for _, conn := range c.connections {
-		_, err := (*conn).Write(msg)
+		_, err := (*conn).Write(frame)
 		if err != nil {
 			fmt.Printf("Error in client sending msg: %v", err)
 			panic(err)
@@ -164,7 +269,7 @@ func (c *Client) sendRequest(msg []byte) {
 }
 
 func (c *Client) countTolerateFaultNode() int {
-	return (len(c.knownNodes) - 1) / 3
+	return faultTolerance(len(c.knownNodes))
 }
 
 func (c *Client) countNeedReceiveMsgAmount() int {
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// message codecs, selected with the codec key of system config
+const (
+	codecJSON   = 0
+	codecBinary = 1
+)
+
+// encodeMsg encodes the messages that have a binary form with the configured codec,
+// every other message is JSON. The binary form is canonical, so digests over it
+// are the same on every replica
+func encodeMsg(msg interface{}) ([]byte, error) {
+	if m, ok := msg.(encoding.BinaryMarshaler); ok && MsgCodec == codecBinary {
+		return m.MarshalBinary()
+	}
+	return json.Marshal(msg)
+}
+
+func decodeMsg(data []byte, msg interface{}) error {
+	if m, ok := msg.(encoding.BinaryUnmarshaler); ok && MsgCodec == codecBinary {
+		return m.UnmarshalBinary(data)
+	}
+	return json.Unmarshal(data, msg)
+}
+
+// binary layout: integers are zigzag varints, strings and byte slices are
+// prefixed with their length as an uvarint, fields follow their declaration order.
+// The decoder only accepts the shortest encoding of a varint
+
+type msgEncoder struct {
+	buf []byte
+}
+
+func (e *msgEncoder) putInt(v int) {
+	e.buf = binary.AppendVarint(e.buf, int64(v))
+}
+
+func (e *msgEncoder) putBytes(b []byte) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgEncoder) putString(s string) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+type msgDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *msgDecoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 || n != len(binary.AppendVarint(nil, v)) {
+		d.err = fmt.Errorf("invalid varint")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return int(v)
+}
+
+func (d *msgDecoder) length() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 || n != len(binary.AppendUvarint(nil, v)) || v > uint64(len(d.buf)-n) {
+		d.err = fmt.Errorf("invalid length")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return int(v)
+}
+
+func (d *msgDecoder) bool() bool {
+	v := d.int()
+	if d.err == nil && v != 0 && v != 1 {
+		d.err = fmt.Errorf("invalid bool %d", v)
+	}
+	return v == 1
+}
+
+func (d *msgDecoder) bytes() []byte {
+	l := d.length()
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, l)
+	copy(b, d.buf[:l])
+	d.buf = d.buf[l:]
+	return b
+}
+
+func (d *msgDecoder) string() string {
+	l := d.length()
+	if d.err != nil {
+		return ""
+	}
+	s := string(d.buf[:l])
+	d.buf = d.buf[l:]
+	return s
+}
+
+// done fails on trailing bytes, a message has a single encoding
+func (d *msgDecoder) done() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = fmt.Errorf("%d trailing bytes", len(d.buf))
+	}
+	return d.err
+}
+
+func (msg RequestMsg) MarshalBinary() ([]byte, error) {
+	e := &msgEncoder{}
+	msg.encode(e)
+	return e.buf, nil
+}
+
+func (msg RequestMsg) encode(e *msgEncoder) {
+	e.putString(msg.Operation)
+	e.putInt(msg.Timestamp)
+	e.putInt(msg.ClientID)
+	e.putString(msg.CRequest.Message)
+	e.putString(msg.CRequest.Digest)
+}
+
+func (msg *RequestMsg) UnmarshalBinary(data []byte) error {
+	d := &msgDecoder{buf: data}
+	msg.decode(d)
+	return d.done()
+}
+
+func (msg *RequestMsg) decode(d *msgDecoder) {
+	msg.Operation = d.string()
+	msg.Timestamp = d.int()
+	msg.ClientID = d.int()
+	msg.CRequest.Message = d.string()
+	msg.CRequest.Digest = d.string()
+}
+
+// encodeRequests writes a batch with the client signatures, batch digests hash this encoding
+func encodeRequests(e *msgEncoder, requests []SignedRequestMsg) {
+	e.putInt(len(requests))
+	for _, request := range requests {
+		request.Request.encode(e)
+		e.putBytes(request.Signature)
+	}
+}
+
+func (msg PrePrepareMsg) MarshalBinary() ([]byte, error) {
+	e := &msgEncoder{}
+	encodeRequests(e, msg.Requests)
+	e.putString(msg.Digest)
+	e.putInt(msg.ViewID)
+	e.putInt(msg.SequenceID)
+	e.putInt(len(msg.Weights))
+	for _, weight := range msg.Weights {
+		e.putInt(weight)
+	}
+	return e.buf, nil
+}
+
+func (msg *PrePrepareMsg) UnmarshalBinary(data []byte) error {
+	d := &msgDecoder{buf: data}
+	count := d.int()
+	if count < 0 || count > len(data) {
+		return fmt.Errorf("invalid batch size %d", count)
+	}
+	msg.Requests = make([]SignedRequestMsg, count)
+	for i := range msg.Requests {
+		msg.Requests[i].Request.decode(d)
+		msg.Requests[i].Signature = d.bytes()
+	}
+	msg.Digest = d.string()
+	msg.ViewID = d.int()
+	msg.SequenceID = d.int()
+	weights := d.int()
+	if weights < 0 || weights > len(data) {
+		return fmt.Errorf("invalid weight count %d", weights)
+	}
+	if weights > 0 {
+		msg.Weights = make([]int, weights)
+		for i := range msg.Weights {
+			msg.Weights[i] = d.int()
+		}
+	}
+	return d.done()
+}
+
+func (msg PrepareMsg) MarshalBinary() ([]byte, error) {
+	e := &msgEncoder{}
+	e.putString(msg.Digest)
+	e.putInt(msg.ViewID)
+	e.putInt(msg.SequenceID)
+	e.putInt(msg.NodeID)
+	return e.buf, nil
+}
+
+func (msg *PrepareMsg) UnmarshalBinary(data []byte) error {
+	d := &msgDecoder{buf: data}
+	msg.Digest = d.string()
+	msg.ViewID = d.int()
+	msg.SequenceID = d.int()
+	msg.NodeID = d.int()
+	return d.done()
+}
+
+func (msg CommitMsg) MarshalBinary() ([]byte, error) {
+	e := &msgEncoder{}
+	e.putString(msg.Digest)
+	e.putInt(msg.ViewID)
+	e.putInt(msg.SequenceID)
+	e.putInt(msg.NodeID)
+	return e.buf, nil
+}
+
+func (msg *CommitMsg) UnmarshalBinary(data []byte) error {
+	d := &msgDecoder{buf: data}
+	msg.Digest = d.string()
+	msg.ViewID = d.int()
+	msg.SequenceID = d.int()
+	msg.NodeID = d.int()
+	return d.done()
+}
+
+func (msg ReplyMsg) MarshalBinary() ([]byte, error) {
+	e := &msgEncoder{}
+	e.putInt(msg.ViewID)
+	e.putInt(msg.Timestamp)
+	e.putInt(msg.ClientID)
+	e.putInt(msg.NodeID)
+	e.putString(msg.Result)
+	fastPath := 0
+	if msg.FastPath {
+		fastPath = 1
+	}
+	e.putInt(fastPath)
+	return e.buf, nil
+}
+
+func (msg *ReplyMsg) UnmarshalBinary(data []byte) error {
+	d := &msgDecoder{buf: data}
+	msg.ViewID = d.int()
+	msg.Timestamp = d.int()
+	msg.ClientID = d.int()
+	msg.NodeID = d.int()
+	msg.Result = d.string()
+	msg.FastPath = d.bool()
+	return d.done()
+}
+
+func (msg PrepareCertMsg) MarshalBinary() ([]byte, error) {
+	e := &msgEncoder{}
+	e.putString(msg.Digest)
+	e.putInt(msg.ViewID)
+	e.putInt(msg.SequenceID)
+	e.putInt(len(msg.Prepares))
+	for _, prepare := range msg.Prepares {
+		e.putInt(prepare.Prepare.NodeID)
+		e.putBytes(prepare.Signature)
+	}
+	e.putInt(msg.NodeID)
+	return e.buf, nil
+}
+
+// the votes of a certificate only carry their sender and signature,
+// the rest of each vote is the one of the certificate
+func (msg *PrepareCertMsg) UnmarshalBinary(data []byte) error {
+	d := &msgDecoder{buf: data}
+	msg.Digest = d.string()
+	msg.ViewID = d.int()
+	msg.SequenceID = d.int()
+	count := d.int()
+	if count < 0 || count > len(data) {
+		return fmt.Errorf("invalid certificate size %d", count)
+	}
+	msg.Prepares = make([]SignedPrepareMsg, count)
+	for i := range msg.Prepares {
+		msg.Prepares[i].Prepare = PrepareMsg{msg.Digest, msg.ViewID, msg.SequenceID, d.int()}
+		msg.Prepares[i].Signature = d.bytes()
+	}
+	msg.NodeID = d.int()
+	return d.done()
+}
+
+func (msg CommitCertMsg) MarshalBinary() ([]byte, error) {
+	e := &msgEncoder{}
+	e.putString(msg.Digest)
+	e.putInt(msg.ViewID)
+	e.putInt(msg.SequenceID)
+	e.putInt(len(msg.Commits))
+	for _, commit := range msg.Commits {
+		e.putInt(commit.Commit.NodeID)
+		e.putBytes(commit.Signature)
+	}
+	e.putInt(msg.NodeID)
+	return e.buf, nil
+}
+
+func (msg *CommitCertMsg) UnmarshalBinary(data []byte) error {
+	d := &msgDecoder{buf: data}
+	msg.Digest = d.string()
+	msg.ViewID = d.int()
+	msg.SequenceID = d.int()
+	count := d.int()
+	if count < 0 || count > len(data) {
+		return fmt.Errorf("invalid certificate size %d", count)
+	}
+	msg.Commits = make([]SignedCommitMsg, count)
+	for i := range msg.Commits {
+		msg.Commits[i].Commit = CommitMsg{msg.Digest, msg.ViewID, msg.SequenceID, d.int()}
+		msg.Commits[i].Signature = d.bytes()
+	}
+	msg.NodeID = d.int()
+	return d.done()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"reflect"
+	"testing"
+)
+
+type codecCase struct {
+	name    string
+	msg     encoding.BinaryMarshaler
+	decoded func() encoding.BinaryUnmarshaler
+}
+
+func codecCases() []codecCase {
+	request := RequestMsg{"put", 1700000000000000000, 3, Request{"payload", "digest"}}
+	return []codecCase{
+		{"request", request, func() encoding.BinaryUnmarshaler { return &RequestMsg{} }},
+		{"pre-prepare", PrePrepareMsg{
+			[]SignedRequestMsg{{request, []byte{1, 2, 3}}, {request, []byte{}}},
+			"batch", 2, 41, nil,
+		}, func() encoding.BinaryUnmarshaler { return &PrePrepareMsg{} }},
+		{"weighted pre-prepare", PrePrepareMsg{
+			[]SignedRequestMsg{{request, []byte{4}}},
+			"batch", 0, 7, []int{2, 2, 1, 1, 1},
+		}, func() encoding.BinaryUnmarshaler { return &PrePrepareMsg{} }},
+		{"prepare", PrepareMsg{"digest", 1, -1, 2}, func() encoding.BinaryUnmarshaler { return &PrepareMsg{} }},
+		{"commit", CommitMsg{"digest", 1, 300, 3}, func() encoding.BinaryUnmarshaler { return &CommitMsg{} }},
+		{"reply", ReplyMsg{1, 1700000000000000000, 3, 0, "OK", true}, func() encoding.BinaryUnmarshaler { return &ReplyMsg{} }},
+		{"prepare certificate", PrepareCertMsg{"digest", 1, 9, []SignedPrepareMsg{
+			{PrepareMsg{"digest", 1, 9, 2}, []byte{5, 6}},
+			{PrepareMsg{"digest", 1, 9, 3}, []byte{7}},
+		}, 1}, func() encoding.BinaryUnmarshaler { return &PrepareCertMsg{} }},
+		{"commit certificate", CommitCertMsg{"digest", 1, 9, []SignedCommitMsg{
+			{CommitMsg{"digest", 1, 9, 0}, []byte{8}},
+		}, 1}, func() encoding.BinaryUnmarshaler { return &CommitCertMsg{} }},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, tt := range codecCases() {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := tt.decoded()
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			got := reflect.ValueOf(decoded).Elem().Interface()
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Fatalf("decoded %+v, want %+v", got, tt.msg)
+			}
+			// the encoding is canonical: decoding and encoding again gives the same bytes
+			again, err := got.(encoding.BinaryMarshaler).MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, data) {
+				t.Fatalf("encoded %x, then %x", data, again)
+			}
+		})
+	}
+}
+
+func TestCodecRejectsTruncated(t *testing.T) {
+	for _, tt := range codecCases() {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := tt.msg.MarshalBinary()
+			for i := 0; i < len(data); i++ {
+				if err := tt.decoded().UnmarshalBinary(data[:i]); err == nil {
+					t.Fatalf("accepted the first %d of %d bytes", i, len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestCodecRejectsTrailing(t *testing.T) {
+	for _, tt := range codecCases() {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := tt.msg.MarshalBinary()
+			if err := tt.decoded().UnmarshalBinary(append(data, 0)); err == nil {
+				t.Fatal("accepted a trailing byte")
+			}
+		})
+	}
+}
+
+func TestCodecRejectsNonCanonical(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		msg  encoding.BinaryUnmarshaler
+	}{
+		// digest "d", view 1, sequence 2 written on two bytes, node 3
+		{"overlong varint", []byte{1, 'd', 2, 0x84, 0x00, 6}, &PrepareMsg{}},
+		// digest "d" with its length written on two bytes
+		{"overlong length", []byte{0x81, 0x00, 'd', 2, 4, 6}, &CommitMsg{}},
+		// fast path flag 2
+		{"invalid bool", []byte{2, 2, 2, 0, 0, 4}, &ReplyMsg{}},
+		{"negative batch size", []byte{1}, &PrePrepareMsg{}},
+		{"oversized length", []byte{0x7f, 'd'}, &PrepareMsg{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.msg.UnmarshalBinary(tt.data); err == nil {
+				t.Fatalf("accepted %x as %+v", tt.data, tt.msg)
+			}
+		})
+	}
+	// the same messages written canonically are accepted
+	var prepare PrepareMsg
+	if err := prepare.UnmarshalBinary([]byte{1, 'd', 2, 4, 6}); err != nil || prepare != (PrepareMsg{"d", 1, 2, 3}) {
+		t.Fatalf("decoded %+v, %v", prepare, err)
+	}
+}
+
+func TestEncodeMsgFollowsCodec(t *testing.T) {
+	defer func(codec int) { MsgCodec = codec }(MsgCodec)
+	msg := CommitMsg{"digest", 1, 2, 3}
+	for _, codec := range []int{codecJSON, codecBinary} {
+		MsgCodec = codec
+		data, err := encodeMsg(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (data[0] == '{') != (codec == codecJSON) {
+			t.Fatalf("codec %d encoded %q", codec, data)
+		}
+		var decoded CommitMsg
+		if err := decodeMsg(data, &decoded); err != nil || decoded != msg {
+			t.Fatalf("codec %d decoded %+v, %v", codec, decoded, err)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"sort"
+)
+
+// collectorMode replaces the all-to-all prepare and commit phases with votes sent to
+// a collector, enabled by the collector key of system config. The collector aggregates
+// a quorum of prepares and of commits into certificates it broadcasts, so each phase costs
+// O(n) messages instead of O(n²). A certificate carries every signature of its quorum,
+// the standard library has no threshold or aggregate signature scheme
+func collectorMode() bool {
+	return SystemConfig["collector"] == 1
+}
+
+// collectorOf is the replica collecting the votes of view, its primary
+func (node *Node) collectorOf(view int) int {
+	return node.primaryOf(view)
+}
+
+// collectPrepares broadcasts the prepare certificate of digest once the collector
+// logged a quorum of prepares, and adds its own commit to the ones it collects
+func (node *Node) collectPrepares(prepareMsg PrepareMsg, weights []int) {
+	node.mutex.Lock()
+	if node.msgLog.commitLog[prepareMsg.Digest][node.nodeID] {
+		node.mutex.Unlock()
+		return
+	}
+	prepares := []SignedPrepareMsg{}
+	senders := map[int]bool{node.primaryOf(prepareMsg.ViewID): true}
+	for _, prepare := range node.msgLog.prepareMsgs[prepareMsg.Digest] {
+		if prepare.Prepare.ViewID == prepareMsg.ViewID && prepare.Prepare.SequenceID == prepareMsg.SequenceID {
+			prepares = append(prepares, *prepare)
+			senders[prepare.Prepare.NodeID] = true
+		}
+	}
+	node.mutex.Unlock()
+	if !node.quorum.isQuorum(weights, senders) {
+		return
+	}
+	sort.Slice(prepares, func(i, j int) bool {
+		return prepares[i].Prepare.NodeID < prepares[j].Prepare.NodeID
+	})
+	certMsg := PrepareCertMsg{
+		prepareMsg.Digest,
+		prepareMsg.ViewID,
+		prepareMsg.SequenceID,
+		prepares,
+		node.nodeID,
+	}
+	sig, err := node.signMessage(certMsg)
+	if err != nil {
+		return
+	}
+	commitMsg := CommitMsg{
+		prepareMsg.Digest,
+		prepareMsg.ViewID,
+		prepareMsg.SequenceID,
+		node.nodeID,
+	}
+	commitSig, err := node.signMessage(commitMsg)
+	if err != nil {
+		return
+	}
+	node.mutex.Lock()
+	node.logCommit(commitMsg, commitSig)
+	node.mutex.Unlock()
+	logBroadcastMsg(hPrepareCert, certMsg)
+	node.broadcast(ComposeMsg(hPrepareCert, certMsg, sig))
+	node.collectCommits(commitMsg, weights)
+}
+
+// collectCommits broadcasts the commit certificate of digest once the collector
+// logged a quorum of commits, and commits the batch itself
+func (node *Node) collectCommits(commitMsg CommitMsg, weights []int) {
+	node.mutex.Lock()
+	if node.msgLog.commitCerts[commitMsg.Digest] {
+		node.mutex.Unlock()
+		return
+	}
+	commits := []SignedCommitMsg{}
+	senders := make(map[int]bool)
+	for _, commit := range node.msgLog.commitMsgs[commitMsg.Digest] {
+		if commit.Commit.ViewID == commitMsg.ViewID && commit.Commit.SequenceID == commitMsg.SequenceID {
+			commits = append(commits, *commit)
+			senders[commit.Commit.NodeID] = true
+		}
+	}
+	if !node.quorum.isQuorum(weights, senders) {
+		node.mutex.Unlock()
+		return
+	}
+	node.msgLog.commitCerts[commitMsg.Digest] = true
+	node.mutex.Unlock()
+	sort.Slice(commits, func(i, j int) bool {
+		return commits[i].Commit.NodeID < commits[j].Commit.NodeID
+	})
+	certMsg := CommitCertMsg{
+		commitMsg.Digest,
+		commitMsg.ViewID,
+		commitMsg.SequenceID,
+		commits,
+		node.nodeID,
+	}
+	sig, err := node.signMessage(certMsg)
+	if err != nil {
+		return
+	}
+	logBroadcastMsg(hCommitCert, certMsg)
+	node.broadcast(ComposeMsg(hCommitCert, certMsg, sig))
+	node.commit(commitMsg.SequenceID, commitMsg.Digest)
+}
+
+// handlePrepareCert logs the prepares of a certificate, the replica is then prepared
+// and sends its commit to the collector
+func (node *Node) handlePrepareCert(payload []byte, sig []byte) {
+	var certMsg PrepareCertMsg
+	err := decodeMsg(payload, &certMsg)
+	if err != nil {
+		Logger.Error("Error happened in handle PrepareCert:%v", err)
+		return
+	}
+	if !node.checkView(hPrepareCert, certMsg.ViewID, certMsg.SequenceID, certMsg.NodeID, payload, sig) {
+		return
+	}
+	logHandleMsg(hPrepareCert, certMsg, certMsg.NodeID)
+	if !node.inWatermarks(certMsg.SequenceID) {
+		return
+	}
+	prePrepare := node.matchesPrePrepare(certMsg.Digest, certMsg.SequenceID)
+	senders := map[int]bool{node.primaryOf(certMsg.ViewID): true}
+	for _, prepare := range certMsg.Prepares {
+		senders[prepare.Prepare.NodeID] = true
+	}
+	if prePrepare == nil || !node.quorum.isQuorum(prePrepare.Weights, senders) {
+		Logger.Errorf("Prepare certificate for sequence %d does not hold a quorum", certMsg.SequenceID)
+		return
+	}
+	commitMsg := CommitMsg{
+		certMsg.Digest,
+		certMsg.ViewID,
+		certMsg.SequenceID,
+		node.nodeID,
+	}
+	node.mutex.Lock()
+	if node.msgLog.commitLog[certMsg.Digest][node.nodeID] {
+		node.mutex.Unlock()
+		return
+	}
+	// the prepares back the prepared certificates of a view change
+	for _, prepare := range certMsg.Prepares {
+		node.logPrepare(prepare.Prepare, prepare.Signature)
+	}
+	if node.msgLog.commitLog[commitMsg.Digest] == nil {
+		node.msgLog.commitLog[commitMsg.Digest] = make(map[int]bool)
+	}
+	node.msgLog.commitLog[commitMsg.Digest][node.nodeID] = true
+	node.mutex.Unlock()
+	commitSig, err := node.signMessage(commitMsg)
+	if err != nil {
+		return
+	}
+	node.send(node.collectorOf(certMsg.ViewID), ComposeMsg(hCommit, commitMsg, commitSig))
+}
+
+// handleCommitCert commits a batch on the quorum of commits gathered by the collector
+func (node *Node) handleCommitCert(payload []byte, sig []byte) {
+	var certMsg CommitCertMsg
+	err := decodeMsg(payload, &certMsg)
+	if err != nil {
+		Logger.Error("Error happened in handle CommitCert:%v", err)
+		return
+	}
+	if !node.checkView(hCommitCert, certMsg.ViewID, certMsg.SequenceID, certMsg.NodeID, payload, sig) {
+		return
+	}
+	logHandleMsg(hCommitCert, certMsg, certMsg.NodeID)
+	if !node.inWatermarks(certMsg.SequenceID) {
+		return
+	}
+	prePrepare := node.matchesPrePrepare(certMsg.Digest, certMsg.SequenceID)
+	senders := make(map[int]bool)
+	for _, commit := range certMsg.Commits {
+		senders[commit.Commit.NodeID] = true
+	}
+	if prePrepare == nil || !node.quorum.isQuorum(prePrepare.Weights, senders) {
+		Logger.Errorf("Commit certificate for sequence %d does not hold a quorum", certMsg.SequenceID)
+		return
+	}
+	node.commit(certMsg.SequenceID, certMsg.Digest)
+}
+
+// matchesPrePrepare returns the pre-prepare of digest at seq the replica accepted, if any
+func (node *Node) matchesPrePrepare(digest string, seq int) *PrePrepareMsg {
+	node.mutex.Lock()
+	prePrepare := node.msgLog.prePrepareMsgs[digest]
+	node.mutex.Unlock()
+	if prePrepare == nil {
+		Logger.Errorf("No preprepare for digest %s", digest)
+		return nil
+	}
+	if prePrepare.PrePrepare.SequenceID != seq {
+		Logger.Errorf("Sequence %d does not match preprepare sequence %d", seq, prePrepare.PrePrepare.SequenceID)
+		return nil
+	}
+	return &prePrepare.PrePrepare
+}
+
+// must be called with node.mutex held
+func (node *Node) logCommit(commitMsg CommitMsg, sig []byte) {
+	if node.msgLog.commitLog[commitMsg.Digest] == nil {
+		node.msgLog.commitLog[commitMsg.Digest] = make(map[int]bool)
+	}
+	if node.msgLog.commitMsgs[commitMsg.Digest] == nil {
+		node.msgLog.commitMsgs[commitMsg.Digest] = make(map[int]*SignedCommitMsg)
+	}
+	node.msgLog.commitLog[commitMsg.Digest][commitMsg.NodeID] = true
+	node.msgLog.commitMsgs[commitMsg.Digest][commitMsg.NodeID] = &SignedCommitMsg{commitMsg, sig}
+}
+
+// verifyPrepareCert checks the collector's signature and the prepares matching the certificate,
+// whether they hold a quorum depends on the weights of the pre-prepare
+func (node *Node) verifyPrepareCert(certMsg *PrepareCertMsg, sig []byte) bool {
+	collector := node.collectorOf(certMsg.ViewID)
+	if certMsg.NodeID != collector {
+		node.rejectReplicaMsg(hPrepareCert, certMsg.NodeID, "not the collector")
+		return false
+	}
+	if !node.verifyReplicaMsg(hPrepareCert, collector, *certMsg, sig) {
+		return false
+	}
+	for _, prepare := range certMsg.Prepares {
+		msg := prepare.Prepare
+		if msg.Digest != certMsg.Digest || msg.ViewID != certMsg.ViewID ||
+			msg.SequenceID != certMsg.SequenceID || msg.NodeID == node.primaryOf(certMsg.ViewID) {
+			node.rejectReplicaMsg(hPrepareCert, collector, "prepare does not match")
+			return false
+		}
+		pubkey := node.findNodePubkey(msg.NodeID)
+		if pubkey == nil || !verifySignatrue(msg, prepare.Signature, pubkey) {
+			node.rejectReplicaMsg(hPrepareCert, collector, "invalid prepare signature")
+			return false
+		}
+	}
+	return true
+}
+
+// verifyCommitCert checks the collector's signature and the commits matching the certificate
+func (node *Node) verifyCommitCert(certMsg *CommitCertMsg, sig []byte) bool {
+	collector := node.collectorOf(certMsg.ViewID)
+	if certMsg.NodeID != collector {
+		node.rejectReplicaMsg(hCommitCert, certMsg.NodeID, "not the collector")
+		return false
+	}
+	if !node.verifyReplicaMsg(hCommitCert, collector, *certMsg, sig) {
+		return false
+	}
+	for _, commit := range certMsg.Commits {
+		msg := commit.Commit
+		if msg.Digest != certMsg.Digest || msg.ViewID != certMsg.ViewID || msg.SequenceID != certMsg.SequenceID {
+			node.rejectReplicaMsg(hCommitCert, collector, "commit does not match")
+			return false
+		}
+		pubkey := node.findNodePubkey(msg.NodeID)
+		if pubkey == nil || !verifySignatrue(msg, commit.Signature, pubkey) {
+			node.rejectReplicaMsg(hCommitCert, collector, "invalid commit signature")
+			return false
+		}
+	}
+	return true
+}
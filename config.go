@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"crypto/ed25519"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
@@ -54,18 +53,28 @@ func ReadHostsConfig(filePath string) ([]*NodeInfo, error) {
 			os.Exit(1)
 		}
 
+		weight := 1
+		if len(parts) > 5 {
+			weight, err = strconv.Atoi(parts[5])
+			if err != nil || weight <= 0 {
+				fmt.Println("Error parsing hosts file, Invalid weight: ", parts[5])
+				os.Exit(1)
+			}
+		}
+
 		replicas = append(replicas, &NodeInfo{
 			nodeID:            id,
 			ip:                ip,
 			clientPort:        cPort,
 			consensusPort:     sPort,
 			stateTransferPort: stPort,
+			weight:            weight,
 		})
 	}
 	// Print out the replicas to verify
 	fmt.Println("Replicas:")
 	for _, replica := range replicas {
-		fmt.Printf("NodeID: %d, IP: %s, Ports: %d %d %d\n", replica.nodeID, replica.ip, replica.clientPort, replica.consensusPort, replica.stateTransferPort)
+		fmt.Printf("NodeID: %d, IP: %s, Ports: %d %d %d, Weight: %d\n", replica.nodeID, replica.ip, replica.clientPort, replica.consensusPort, replica.stateTransferPort, replica.weight)
 	}
 	return replicas, nil
 }
@@ -123,46 +132,91 @@ func ReadPublicKeys(path string, nodeTable []*NodeInfo) {
 			return
 		}
 
+		nodeInfo.pubKey = PublicKeyDecode(pubBytes)
+	}
+}
+
+// ReadClientPublicKeys loads every <id>.pub file of the client keys directory
+func ReadClientPublicKeys(path string) map[int]*ClientNodeInfo {
+	clients := make(map[int]*ClientNodeInfo)
+	files, err := os.ReadDir(path)
+	if err != nil {
+		fmt.Println("Error reading client keys", err)
+		return clients
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".pub") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ".pub"))
+		if err != nil {
+			fmt.Println("Error parsing client key file name: ", name)
+			continue
+		}
+		pubBytes, err := os.ReadFile(fmt.Sprintf("%s/%s", path, name))
+		if err != nil {
+			fmt.Println("Error reading client public key", err)
+			continue
+		}
 		decodePubKey := PublicKeyDecode(pubBytes)
-		nodeInfo.pubKey = &decodePubKey
+		if decodePubKey == nil {
+			continue
+		}
+		clients[id] = &ClientNodeInfo{
+			nodeID: id,
+			pubkey: decodePubKey,
+		}
 	}
+	return clients
 }
 
-func ReadPrivateKey(path string, nodeID int) *ed25519.PrivateKey {
+func ReadPrivateKey(path string, nodeID int) Signer {
 	privKeyFile := fmt.Sprintf("%s/%d.priv", path, nodeID)
 	privbytes, err := os.ReadFile(privKeyFile)
 	if err != nil {
 		fmt.Println("Error reading private key", err)
 		return nil
 	}
-	decodePrivKey := PrivateKeyDecode(privbytes)
-
-	// Convert ed25519.PrivateKey to *ecdsa.PrivateKey
-	ecdsaPrivKey := &decodePrivKey
-
-	return ecdsaPrivKey
+	return PrivateKeyDecode(privbytes)
 }
 
-func PrivateKeyDecode(pemEncoded []byte) ed25519.PrivateKey {
+// PrivateKeyDecode accepts PKCS8 keys and the SEC1 keys written by key_gen_ecdsa.sh,
+// the key must belong to the signature scheme of system config
+func PrivateKeyDecode(pemEncoded []byte) Signer {
 	blockPriv, _ := pem.Decode(pemEncoded)
+	if blockPriv == nil {
+		fmt.Println("Invalid private key file")
+		return nil
+	}
 	x509Encoded := blockPriv.Bytes
 
-	bytes, _ := x509.ParsePKCS8PrivateKey(x509Encoded)
-	privateKey, ok := bytes.(ed25519.PrivateKey)
-	if !ok {
-		fmt.Printf("Not an Ed25519 private key")
+	var key interface{}
+	key, err := x509.ParsePKCS8PrivateKey(x509Encoded)
+	if err != nil {
+		key, err = x509.ParseECPrivateKey(x509Encoded)
+	}
+	signer := newSigner(key)
+	if err != nil || signer == nil || signer.Scheme() != signatureScheme() {
+		fmt.Printf("Not a private key of signature scheme %d\n", signatureScheme())
+		return nil
 	}
-	return privateKey
+	return signer
 }
 
-func PublicKeyDecode(pemEncoded []byte) ed25519.PublicKey {
+func PublicKeyDecode(pemEncoded []byte) Verifier {
 	blockPub, _ := pem.Decode(pemEncoded)
+	if blockPub == nil {
+		fmt.Println("Invalid public key file")
+		return nil
+	}
 	x509EncodedPub := blockPub.Bytes
 
-	bytes, _ := x509.ParsePKIXPublicKey(x509EncodedPub)
-	publicKey, ok := bytes.(ed25519.PublicKey)
-	if !ok {
-		fmt.Printf("Not an Ed25519 private key")
+	key, err := x509.ParsePKIXPublicKey(x509EncodedPub)
+	verifier := newVerifier(key)
+	if err != nil || verifier == nil || verifier.Scheme() != signatureScheme() {
+		fmt.Printf("Not a public key of signature scheme %d\n", signatureScheme())
+		return nil
 	}
-	return publicKey
+	return verifier
 }
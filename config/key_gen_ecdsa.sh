@@ -5,14 +5,15 @@ NC='\033[0m'
 
 if [[ $# -lt 1 ]]
 then
-	echo "Usage: $0 <number of nodes>"
+	echo "Usage: $0 <number of nodes> [key directory]"
 	echo "Example: $0 100"
+	echo "Example: $0 1 client_keys"
 
 	exit
 fi
 
 NUMNODES=$1
-KEYPATH="keys"
+KEYPATH=${2:-keys}
 
 # Remove existing keys.
 
@@ -32,13 +33,14 @@ do
 	j=$((i-1))
 	PRIVKEYFILE="$KEYPATH/$j.priv"
 	PUBKEYFILE="$KEYPATH/$j.pub"
+	CERTFILE="$KEYPATH/$j.crt"
 
 	(
-	 # NIST says secp224r1 is as strong as rsa-2048.
-	 # Refer to Table 2-1 from:
-	 # https://dx.doi.org/10.6028/NIST.SP.800-57pt3r1
-	 openssl ecparam -name secp224r1 -genkey -noout -out $PRIVKEYFILE
+	 # P-256 keys, used when sigScheme=1 in system.config
+	 openssl ecparam -name prime256v1 -genkey -noout -out $PRIVKEYFILE
 	 openssl ec -in $PRIVKEYFILE -pubout -out $PUBKEYFILE
+	 # Self-signed certificate bound to the key, used when TLS is enabled in system.config
+	 openssl req -new -x509 -key $PRIVKEYFILE -out $CERTFILE -days 3650 -subj "/CN=$j"
 	) &
 done
 
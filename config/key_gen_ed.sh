@@ -5,13 +5,14 @@ NC='\033[0m'
 
 if [[ $# -lt 1 ]]
 then
-    echo -e "${RED}Usage: $0 <number of nodes>${NC}"
+    echo -e "${RED}Usage: $0 <number of nodes> [key directory]${NC}"
     echo "Example: $0 100"
+    echo "Example: $0 1 client_keys"
     exit 1
 fi
 
 NUMNODES=$1
-KEYPATH="keys"
+KEYPATH=${2:-keys}
 
 # Remove existing keys.
 rm -rf $KEYPATH
@@ -30,11 +31,14 @@ do
     j=$((i-1))
     PRIVKEYFILE="$KEYPATH/$j.priv"
     PUBKEYFILE="$KEYPATH/$j.pub"
+    CERTFILE="$KEYPATH/$j.crt"
 
     (
      # Generating Ed25519 key pairs
      openssl genpkey -algorithm Ed25519 -out $PRIVKEYFILE
      openssl pkey -in $PRIVKEYFILE -pubout -out $PUBKEYFILE
+     # Self-signed certificate bound to the key, used when TLS is enabled in system.config
+     openssl req -new -x509 -key $PRIVKEYFILE -out $CERTFILE -days 3650 -subj "/CN=$j"
     ) &
 done
 
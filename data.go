@@ -1,22 +1,24 @@
 package main
 
 import (
-	"crypto/ed25519"
-
 	"go.uber.org/zap"
 )
 
 var Replicas []*NodeInfo
+var Clients map[int]*ClientNodeInfo
 var SystemConfig map[string]int
-var PrivateKey *ed25519.PrivateKey
-var SignatureLength = ed25519.SignatureSize
+var PrivateKey Signer
+var MaxFrameSize = defaultMaxFrameSize
+var MsgCodec = codecJSON
 var Logger *zap.SugaredLogger
 
+const replicaKeysPath = "./config/keys"
+const clientKeysPath = "./config/client_keys"
+
 func init() {
 
 	hostsConfigFile := "./config/hosts.config"
 	systemConfigFile := "./config/system.config"
-	keysPath := "./config/keys"
 
 	l, _ := zap.NewDevelopment()
 	defer l.Sync()
@@ -24,6 +26,11 @@ func init() {
 	Logger = l.Sugar()
 	Replicas, _ = ReadHostsConfig(hostsConfigFile)
 	SystemConfig, _ = ReadSystemConfig(systemConfigFile)
+	if size, ok := SystemConfig["maxFrameSize"]; ok && size > 0 {
+		MaxFrameSize = size
+	}
+	MsgCodec = SystemConfig["codec"]
 
-	ReadPublicKeys(keysPath, Replicas)
+	ReadPublicKeys(replicaKeysPath, Replicas)
+	Clients = ReadClientPublicKeys(clientKeysPath)
 }
@@ -0,0 +1,187 @@
+package main
+
+import "fmt"
+
+// commit queues a committed batch until every lower sequence number has executed,
+// so all replicas run the application in the same order
+func (node *Node) commit(seq int, digest string) {
+	node.mutex.Lock()
+	if seq <= node.lastExecuted {
+		node.mutex.Unlock()
+		return
+	}
+	if queued, ok := node.executionQueue[seq]; ok {
+		if queued != digest {
+			Logger.Errorf("Sequence %d committed with digests %s and %s", seq, queued, digest)
+		}
+		node.mutex.Unlock()
+		return
+	}
+	node.executionQueue[seq] = digest
+	node.mutex.Unlock()
+	node.executeReady()
+}
+
+// executeReady releases the queued batches that extend the executed prefix
+func (node *Node) executeReady() {
+	checkpoints := []CheckpointMsg{}
+	replies := []*ReplyMsg{}
+	missing := false
+	node.mutex.Lock()
+	start := node.lastExecuted
+	for {
+		digest, ok := node.executionQueue[node.lastExecuted+1]
+		if !ok {
+			break
+		}
+		if _, ok := node.batchPool[digest]; !ok {
+			Logger.Errorf("Batch %s committed at %d is missing, fetching it from the other replicas", digest, node.lastExecuted+1)
+			missing = true
+			break
+		}
+		node.lastExecuted++
+		delete(node.executionQueue, node.lastExecuted)
+		node.executedSeqs[node.lastExecuted] = digest
+		node.msgLog.replyLog[digest] = true
+		replies = append(replies, node.applyBatch(digest)...)
+		if checkpoint := node.takeCheckpoint(); checkpoint != nil {
+			checkpoints = append(checkpoints, *checkpoint)
+		}
+	}
+	progressed := node.lastExecuted > start
+	node.mutex.Unlock()
+	if missing {
+		node.requestStateTransfer()
+	}
+	if !progressed {
+		return
+	}
+
+	for _, replyMsg := range replies {
+		node.sendReply(replyMsg)
+	}
+	// the requests made progress, restart the timer for the remaining ones
+	node.stopTimer()
+	if node.hasPendingRequests() {
+		node.startTimer()
+	}
+	for _, checkpointMsg := range checkpoints {
+		node.sendCheckpoint(checkpointMsg)
+	}
+}
+
+// requestKey identifies a client request by its client and timestamp, PBFT executes
+// a client's requests in timestamp order, a system request is identified by its digest
+func requestKey(request *RequestMsg) string {
+	if isSystemRequest(request) {
+		return request.CRequest.Digest
+	}
+	return fmt.Sprintf("%d/%d", request.ClientID, request.Timestamp)
+}
+
+// clientRecord is the last request of a client a replica executed, along with its
+// result, so a retransmission is answered without executing the request again
+type clientRecord struct {
+	Timestamp int    `json:"timestamp"`
+	Result    string `json:"result"`
+}
+
+// executed tells whether the request, or a later one of its client, ran already,
+// must be called with node.mutex held
+func (node *Node) executed(request *RequestMsg) bool {
+	record, ok := node.clientTable[request.ClientID]
+	return ok && !isSystemRequest(request) && request.Timestamp <= record.Timestamp
+}
+
+// cachedReply rebuilds the reply to the last executed request of a client, nil for
+// any other request, must be called with node.mutex held
+func (node *Node) cachedReply(request *RequestMsg) *ReplyMsg {
+	record, ok := node.clientTable[request.ClientID]
+	if !ok || record.Timestamp != request.Timestamp {
+		return nil
+	}
+	return node.newReply(request, record.Result)
+}
+
+// admitRequest adds a client request to requestPool, it returns nil for a request the
+// replica holds already or executed, the client gets the cached reply to a retransmission
+func (node *Node) admitRequest(request RequestMsg, sig []byte) *SignedRequestMsg {
+	node.mutex.Lock()
+	key := requestKey(&request)
+	if _, ok := node.requestPool[key]; ok {
+		node.mutex.Unlock()
+		return nil
+	}
+	if node.executed(&request) {
+		reply := node.cachedReply(&request)
+		node.mutex.Unlock()
+		if reply != nil {
+			node.sendReply(reply)
+		}
+		return nil
+	}
+	signed := &SignedRequestMsg{request, sig}
+	node.requestPool[key] = signed
+	node.mutex.Unlock()
+	return signed
+}
+
+// applyBatch runs the requests of a batch in batch order, a request ordered again
+// is answered from clientTable and a request older than its client's last is dropped,
+// must be called with node.mutex held
+func (node *Node) applyBatch(digest string) []*ReplyMsg {
+	replies := []*ReplyMsg{}
+	requests := node.batchPool[digest]
+	for i := range requests {
+		request := &requests[i].Request
+		delete(node.requestPool, requestKey(request))
+		if node.executed(request) {
+			if reply := node.cachedReply(request); reply != nil {
+				replies = append(replies, reply)
+			}
+			continue
+		}
+		if reply := node.applyRequest(request); reply != nil {
+			reply.FastPath = node.msgLog.fastCommits[digest]
+			replies = append(replies, reply)
+		}
+	}
+	return replies
+}
+
+// applyRequest runs a request on the application and builds the reply to its client,
+// must be called with node.mutex held
+func (node *Node) applyRequest(request *RequestMsg) *ReplyMsg {
+	if isWeightsRequest(request) {
+		node.applyWeights(request, node.lastExecuted)
+	}
+	if isSystemRequest(request) {
+		return nil
+	}
+	result := node.app.Execute(request.Operation, request.CRequest.Message)
+	node.clientTable[request.ClientID] = &clientRecord{request.Timestamp, result}
+	return node.newReply(request, result)
+}
+
+// must be called with node.mutex held
+func (node *Node) newReply(request *RequestMsg, result string) *ReplyMsg {
+	return &ReplyMsg{
+		node.View,
+		request.Timestamp, // lets the client match the reply with its request
+		request.ClientID,
+		node.nodeID,
+		result,
+		false, // set for the batch by applyBatch
+	}
+}
+
+// sendReply signs a reply and routes it back to the client that sent the request
+func (node *Node) sendReply(replyMsg *ReplyMsg) {
+	sig, err := node.signMessage(*replyMsg)
+	if err != nil {
+		Logger.Error("Sign reply msg failed:%v", err)
+		return
+	}
+	logBroadcastMsg(hReply, replyMsg)
+	node.sendToClient(replyMsg.ClientID, ComposeMsg(hReply, *replyMsg, sig))
+}
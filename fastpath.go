@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// fastPathMode commits a batch as soon as the prepares of all n replicas arrived
+// within fastPathWindow milliseconds of its pre-prepare, like the fast path of SBFT,
+// enabled by the fastPath key of system config. The replica still sends its commit so
+// the others can fall back to the commit phase. Every correct replica accepted a batch
+// committed this way, so at least f+1 of the n-f replicas of a view change report it,
+// and the new primary proposes it again
+func fastPathMode() bool {
+	return SystemConfig["fastPath"] == 1 && !collectorMode()
+}
+
+func fastPathWindow() time.Duration {
+	window := time.Duration(SystemConfig["fastPathWindow"]) * time.Millisecond
+	if window <= 0 {
+		window = 20 * time.Millisecond
+	}
+	return window
+}
+
+// onFastPath tells whether the prepares of digest from all replicas, the primary
+// included, arrived in time, it holds only once per batch,
+// must be called with node.mutex held
+func (node *Node) onFastPath(digest string, prepares map[int]bool) bool {
+	if !fastPathMode() || node.msgLog.fastCommits[digest] {
+		return false
+	}
+	for _, replica := range node.knownNodes {
+		if !prepares[replica.nodeID] {
+			return false
+		}
+	}
+	if time.Since(node.msgLog.prePrepareAt[digest]) > fastPathWindow() {
+		return false
+	}
+	node.msgLog.fastCommits[digest] = true
+	return true
+}
+
+// collectPrePrepared returns the pre-prepare of the highest view the replica accepted
+// for every sequence number above its stable checkpoint, must be called with node.mutex held
+func (node *Node) collectPrePrepared() []SignedPrePrepareMsg {
+	if !fastPathMode() {
+		return nil
+	}
+	highest := make(map[int]*SignedPrePrepareMsg)
+	for _, prePrepare := range node.msgLog.prePrepareMsgs {
+		seq := prePrepare.PrePrepare.SequenceID
+		if seq <= node.stableSeqID {
+			continue
+		}
+		if prev, ok := highest[seq]; !ok || prePrepare.PrePrepare.ViewID > prev.PrePrepare.ViewID {
+			highest[seq] = prePrepare
+		}
+	}
+	prePrepared := []SignedPrePrepareMsg{}
+	for _, prePrepare := range highest {
+		prePrepared = append(prePrepared, *prePrepare)
+	}
+	sort.Slice(prePrepared, func(i, j int) bool {
+		return prePrepared[i].PrePrepare.SequenceID < prePrepared[j].PrePrepare.SequenceID
+	})
+	return prePrepared
+}
+
+// acceptedBatch is a batch that f+1 view changes report accepting for a sequence number,
+// at least one of them from a correct replica that accepted it in view or a later one
+type acceptedBatch struct {
+	prePrepare *PrePrepareMsg
+	view       int
+}
+
+// acceptedPrePrepares finds the batches accepted by f+1 replicas of the view changes,
+// the ones that may have committed on the fast path
+func acceptedPrePrepares(viewChanges []SignedViewChangeMsg, minS int, f int) map[int]*acceptedBatch {
+	// sequence number -> digest -> replica -> view it accepted the batch in
+	reports := make(map[int]map[string]map[int]int)
+	batches := make(map[string]*PrePrepareMsg)
+	for _, viewChange := range viewChanges {
+		for i := range viewChange.ViewChange.PrePrepared {
+			prePrepare := &viewChange.ViewChange.PrePrepared[i].PrePrepare
+			seq := prePrepare.SequenceID
+			if seq <= minS {
+				continue
+			}
+			if reports[seq] == nil {
+				reports[seq] = make(map[string]map[int]int)
+			}
+			if reports[seq][prePrepare.Digest] == nil {
+				reports[seq][prePrepare.Digest] = make(map[int]int)
+			}
+			reports[seq][prePrepare.Digest][viewChange.ViewChange.NodeID] = prePrepare.ViewID
+			batches[prePrepare.Digest] = prePrepare
+		}
+	}
+	accepted := make(map[int]*acceptedBatch)
+	for seq, byDigest := range reports {
+		for digest, reporters := range byDigest {
+			if len(reporters) <= f {
+				continue
+			}
+			views := []int{}
+			for _, view := range reporters {
+				views = append(views, view)
+			}
+			sort.Sort(sort.Reverse(sort.IntSlice(views)))
+			// f+1 reporters accepted the batch in this view or a later one
+			candidate := &acceptedBatch{batches[digest], views[f]}
+			prev, ok := accepted[seq]
+			if !ok || candidate.view > prev.view ||
+				(candidate.view == prev.view && digest > prev.prePrepare.Digest) {
+				accepted[seq] = candidate
+			}
+		}
+	}
+	return accepted
+}
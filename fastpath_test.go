@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testBatch is a pre-prepare of a batch named after its single request
+func testBatch(name string, view int, seq int) PrePrepareMsg {
+	requests := []SignedRequestMsg{{RequestMsg{"put", 1, 0, Request{name, name}}, []byte{}}}
+	return PrePrepareMsg{requests, batchDigest(requests), view, seq, nil}
+}
+
+// accepting is a view change to view 3 of a replica that accepted the pre-prepares,
+// and prepared the certified ones
+func accepting(nodeID int, accepted []PrePrepareMsg, certified ...PrePrepareMsg) SignedViewChangeMsg {
+	viewChange := ViewChangeMsg{3, -1, nil, []PreparedCert{}, []SignedPrePrepareMsg{}, nodeID}
+	for _, prePrepare := range accepted {
+		viewChange.PrePrepared = append(viewChange.PrePrepared, SignedPrePrepareMsg{prePrepare, []byte{}})
+	}
+	for _, prePrepare := range certified {
+		viewChange.PreparedCerts = append(viewChange.PreparedCerts, PreparedCert{SignedPrePrepareMsg{prePrepare, []byte{}}, nil})
+	}
+	return SignedViewChangeMsg{viewChange, []byte{}}
+}
+
+func batchName(prePrepare PrePrepareMsg) string {
+	request := prePrepare.Requests[0].Request
+	if isNullRequest(&request) {
+		return "null"
+	}
+	return request.CRequest.Message
+}
+
+func TestAcceptedPrePrepares(t *testing.T) {
+	a0, a2 := testBatch("a", 0, 1), testBatch("a", 2, 1)
+	b1 := testBatch("b", 1, 1)
+	tests := []struct {
+		name        string
+		f           int
+		viewChanges []SignedViewChangeMsg
+		batch       string // "" when no batch is accepted
+		view        int
+	}{
+		{"accepted by f+1", 1, []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{a0}),
+			accepting(1, []PrePrepareMsg{a0}),
+			accepting(2, nil),
+		}, "a", 0},
+		{"accepted by f only", 1, []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{a0}),
+			accepting(1, []PrePrepareMsg{b1}),
+			accepting(2, nil),
+		}, "", 0},
+		{"view is the (f+1)th highest reported", 1, []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{a2}),
+			accepting(1, []PrePrepareMsg{a0}),
+			accepting(2, nil),
+		}, "a", 0},
+		{"conflicting batches, the later view wins", 2, []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{a0}),
+			accepting(1, []PrePrepareMsg{a0}),
+			accepting(2, []PrePrepareMsg{a0}),
+			accepting(3, []PrePrepareMsg{b1}),
+			accepting(4, []PrePrepareMsg{b1}),
+			accepting(5, []PrePrepareMsg{b1}),
+		}, "b", 1},
+		{"at or below the stable checkpoint", 1, []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{testBatch("a", 0, 0)}),
+			accepting(1, []PrePrepareMsg{testBatch("a", 0, 0)}),
+			accepting(2, nil),
+		}, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted := acceptedPrePrepares(tt.viewChanges, 0, tt.f)
+			batch, ok := accepted[1]
+			if tt.batch == "" {
+				if ok || len(accepted) > 0 {
+					t.Fatalf("accepted %v", accepted)
+				}
+				return
+			}
+			if !ok || batchName(*batch.prePrepare) != tt.batch || batch.view != tt.view {
+				t.Fatalf("accepted %+v, want %s in view %d", batch, tt.batch, tt.view)
+			}
+		})
+	}
+}
+
+// the order of the view changes must not change the outcome
+func TestAcceptedPrePreparesTieBreak(t *testing.T) {
+	a, b := testBatch("a", 1, 1), testBatch("b", 1, 1)
+	viewChanges := []SignedViewChangeMsg{
+		accepting(0, []PrePrepareMsg{a}),
+		accepting(1, []PrePrepareMsg{a}),
+		accepting(2, []PrePrepareMsg{b}),
+		accepting(3, []PrePrepareMsg{b}),
+	}
+	want := batchName(*acceptedPrePrepares(viewChanges, -1, 1)[1].prePrepare)
+	reversed := []SignedViewChangeMsg{viewChanges[3], viewChanges[2], viewChanges[1], viewChanges[0]}
+	if got := batchName(*acceptedPrePrepares(reversed, -1, 1)[1].prePrepare); got != want {
+		t.Fatalf("picked %s, then %s", want, got)
+	}
+}
+
+func TestComputeNewViewPrePreparesFastPath(t *testing.T) {
+	// no checkpoint is stable yet, the sequence numbers start from 0
+	a0, a2 := testBatch("a", 0, 0), testBatch("a", 2, 0)
+	b1 := testBatch("b", 1, 0)
+	c0 := testBatch("c", 0, 1)
+	tests := []struct {
+		name        string
+		viewChanges []SignedViewChangeMsg
+		batches     []string // by sequence number
+	}{
+		{"batch committed on the fast path is proposed again", []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{a0}),
+			accepting(1, []PrePrepareMsg{a0}),
+			accepting(2, nil),
+		}, []string{"a"}},
+		{"batch accepted by f replicas is not", []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{a0}),
+			accepting(1, nil),
+			accepting(2, nil),
+		}, nil},
+		{"prepared in a later view than accepted", []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{a0}),
+			accepting(1, []PrePrepareMsg{a0}),
+			accepting(2, []PrePrepareMsg{b1}, b1),
+		}, []string{"b"}},
+		{"accepted in a later view than prepared", []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{a2}),
+			accepting(1, []PrePrepareMsg{a2}),
+			accepting(2, []PrePrepareMsg{b1}, b1),
+		}, []string{"a"}},
+		{"a faulty replica reporting a later view does not outweigh a certificate", []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{a2}),
+			accepting(1, []PrePrepareMsg{a0}),
+			accepting(2, []PrePrepareMsg{b1}, b1),
+		}, []string{"b"}},
+		{"gap below an accepted batch is filled with a null request", []SignedViewChangeMsg{
+			accepting(0, []PrePrepareMsg{c0}),
+			accepting(1, []PrePrepareMsg{c0}),
+			accepting(2, nil),
+		}, []string{"null", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prePrepares := computeNewViewPrePrepares(3, tt.viewChanges, 1)
+			got := []string{}
+			for _, prePrepare := range prePrepares {
+				if prePrepare.ViewID != 3 || prePrepare.Digest != batchDigest(prePrepare.Requests) {
+					t.Fatalf("pre-prepare %+v does not belong to view 3", prePrepare)
+				}
+				got = append(got, batchName(prePrepare))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.batches) && !(len(got) == 0 && len(tt.batches) == 0) {
+				t.Fatalf("proposed %v, want %v", got, tt.batches)
+			}
+		})
+	}
+}
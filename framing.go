@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// every message on the wire is framed as
+// | magic (1) | version (1) | payload length (4, big endian) | payload |
+const (
+	frameMagic        byte = 0xBF
+	frameVersion      byte = 1
+	frameHeaderLength      = 6
+)
+
+// used when system config does not set maxFrameSize
+const defaultMaxFrameSize = 4 * 1024 * 1024
+
+// EncodeFrame prefixes a message with the frame header
+func EncodeFrame(payload []byte) []byte {
+	frame := make([]byte, frameHeaderLength+len(payload))
+	frame[0] = frameMagic
+	frame[1] = frameVersion
+	binary.BigEndian.PutUint32(frame[2:frameHeaderLength], uint32(len(payload)))
+	copy(frame[frameHeaderLength:], payload)
+	return frame
+}
+
+// DecodeFrame reads the first frame of data, it returns the payload and the
+// number of bytes the frame takes, or a zero length when data holds only part of it
+func DecodeFrame(data []byte) ([]byte, int, error) {
+	if len(data) < frameHeaderLength {
+		return nil, 0, nil
+	}
+	length, err := checkFrameHeader(data[:frameHeaderLength])
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < frameHeaderLength+length {
+		return nil, 0, nil
+	}
+	// the caller may reuse data once the frame is consumed
+	payload := make([]byte, length)
+	copy(payload, data[frameHeaderLength:frameHeaderLength+length])
+	return payload, frameHeaderLength + length, nil
+}
+
+// ReadFrame blocks until a whole frame is read from r and returns its payload
+func ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, frameHeaderLength)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	length, err := checkFrameHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func checkFrameHeader(header []byte) (int, error) {
+	if header[0] != frameMagic {
+		return 0, fmt.Errorf("invalid frame magic 0x%x", header[0])
+	}
+	if header[1] != frameVersion {
+		return 0, fmt.Errorf("unsupported frame version %d", header[1])
+	}
+	length := binary.BigEndian.Uint32(header[2:frameHeaderLength])
+	if int64(length) > int64(MaxFrameSize) {
+		return 0, fmt.Errorf("frame of %d bytes exceeds the maximum of %d", length, MaxFrameSize)
+	}
+	return int(length), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// rawFrame builds a frame header by hand, so it can be invalid
+func rawFrame(magic byte, version byte, length uint32, payload []byte) []byte {
+	frame := []byte{magic, version, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[2:], length)
+	return append(frame, payload...)
+}
+
+func withMaxFrameSize(t *testing.T, size int) {
+	prev := MaxFrameSize
+	MaxFrameSize = size
+	t.Cleanup(func() { MaxFrameSize = prev })
+}
+
+func TestEncodeFrame(t *testing.T) {
+	frame := EncodeFrame([]byte("hello"))
+	want := rawFrame(frameMagic, frameVersion, 5, []byte("hello"))
+	if !bytes.Equal(frame, want) {
+		t.Fatalf("frame %x, want %x", frame, want)
+	}
+	if empty := EncodeFrame(nil); !bytes.Equal(empty, rawFrame(frameMagic, frameVersion, 0, nil)) {
+		t.Fatalf("empty frame %x", empty)
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	withMaxFrameSize(t, 16)
+	frame := EncodeFrame([]byte("hello"))
+	tests := []struct {
+		name     string
+		data     []byte
+		payload  []byte
+		consumed int
+		fails    bool
+	}{
+		{"empty input", nil, nil, 0, false},
+		{"partial header", frame[:3], nil, 0, false},
+		{"header only", frame[:frameHeaderLength], nil, 0, false},
+		{"partial payload", frame[:len(frame)-1], nil, 0, false},
+		{"whole frame", frame, []byte("hello"), len(frame), false},
+		{"coalesced frames", append(append([]byte{}, frame...), EncodeFrame([]byte("world"))...), []byte("hello"), len(frame), false},
+		{"empty payload", EncodeFrame(nil), []byte{}, frameHeaderLength, false},
+		{"largest frame", EncodeFrame(make([]byte, 16)), make([]byte, 16), frameHeaderLength + 16, false},
+		{"bad magic", rawFrame(0x00, frameVersion, 5, []byte("hello")), nil, 0, true},
+		{"bad version", rawFrame(frameMagic, frameVersion+1, 5, []byte("hello")), nil, 0, true},
+		{"oversized length", rawFrame(frameMagic, frameVersion, 17, nil), nil, 0, true},
+		{"length beyond int32", rawFrame(frameMagic, frameVersion, 0xFFFFFFFF, nil), nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, consumed, err := DecodeFrame(tt.data)
+			if (err != nil) != tt.fails {
+				t.Fatalf("error %v, want failure %v", err, tt.fails)
+			}
+			if consumed != tt.consumed || !bytes.Equal(payload, tt.payload) {
+				t.Fatalf("decoded %q taking %d bytes, want %q taking %d", payload, consumed, tt.payload, tt.consumed)
+			}
+		})
+	}
+}
+
+func TestDecodeFrameCopiesPayload(t *testing.T) {
+	frame := EncodeFrame([]byte("hello"))
+	payload, _, err := DecodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame[frameHeaderLength] = 'j'
+	if string(payload) != "hello" {
+		t.Fatalf("payload %q changed with the buffer", payload)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	withMaxFrameSize(t, 16)
+	tests := []struct {
+		name    string
+		data    []byte
+		payload []byte
+		err     error // nil when any error will do
+		fails   bool
+	}{
+		{"whole frame", EncodeFrame([]byte("hello")), []byte("hello"), nil, false},
+		{"empty payload", EncodeFrame(nil), []byte{}, nil, false},
+		{"closed stream", nil, nil, io.EOF, true},
+		{"partial header", EncodeFrame([]byte("hello"))[:3], nil, io.ErrUnexpectedEOF, true},
+		{"partial payload", EncodeFrame([]byte("hello"))[:8], nil, io.ErrUnexpectedEOF, true},
+		{"bad magic", rawFrame(0x00, frameVersion, 5, []byte("hello")), nil, nil, true},
+		{"bad version", rawFrame(frameMagic, 0, 5, []byte("hello")), nil, nil, true},
+		{"oversized length", rawFrame(frameMagic, frameVersion, 1<<31, nil), nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := ReadFrame(bytes.NewReader(tt.data))
+			if (err != nil) != tt.fails {
+				t.Fatalf("error %v, want failure %v", err, tt.fails)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !bytes.Equal(payload, tt.payload) {
+				t.Fatalf("payload %q, want %q", payload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestReadFrameCoalesced(t *testing.T) {
+	stream := bytes.NewReader(append(EncodeFrame([]byte("hello")), EncodeFrame([]byte("world"))...))
+	for _, want := range []string{"hello", "world"} {
+		payload, err := ReadFrame(stream)
+		if err != nil || string(payload) != want {
+			t.Fatalf("read %q, %v, want %q", payload, err, want)
+		}
+	}
+	if _, err := ReadFrame(stream); err != io.EOF {
+		t.Fatalf("read past the frames: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"fmt"
+
+	getty "github.com/apache/dubbo-getty"
+)
+
+// session attributes used by the handshake
+const (
+	attrChallenge = "challenge" // the challenge this replica sent on the session
+	attrPeerID    = "peerID"    // the replica the session is authenticated as
+	attrKeyShare  = "keyShare"  // the private half of this replica's key share
+)
+
+const challengeLength = 32
+
+// startHandshake sends a fresh challenge on a new consensus session,
+// the peer is not trusted until it signs it
+func (h *NetworkingHub) startHandshake(session getty.Session) {
+	challenge := make([]byte, challengeLength)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		Logger.Errorf("Generating handshake challenge failed:%v", err)
+		session.Close()
+		return
+	}
+	session.SetAttribute(attrChallenge, challenge)
+	keyShare, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		Logger.Errorf("Generating handshake key share failed:%v", err)
+		session.Close()
+		return
+	}
+	session.SetAttribute(attrKeyShare, keyShare)
+	helloMsg := HelloMsg{
+		challenge,
+		h.node.nodeID,
+	}
+	sig, err := h.node.signMessage(helloMsg)
+	if err != nil {
+		session.Close()
+		return
+	}
+	session.Send(ComposeMsg(hHello, helloMsg, sig))
+}
+
+// handleHello answers the peer's challenge with our signature over it and our key share,
+// only hellos signed by another known replica are answered
+func (h *NetworkingHub) handleHello(session getty.Session, payload []byte, sig []byte) {
+	var helloMsg HelloMsg
+	err := decodeMsg(payload, &helloMsg)
+	keyShare, _ := session.GetAttribute(attrKeyShare).(*ecdh.PrivateKey)
+	if err != nil || len(helloMsg.Challenge) != challengeLength || keyShare == nil {
+		Logger.Errorf("Invalid hello from %s", session.RemoteAddr())
+		session.Close()
+		return
+	}
+	if helloMsg.NodeID == h.node.nodeID || !h.node.verifyReplicaMsg(hHello, helloMsg.NodeID, helloMsg, sig) {
+		Logger.Errorf("Rejecting hello from %s claiming to be replica %d", session.RemoteAddr(), helloMsg.NodeID)
+		session.Close()
+		return
+	}
+	ackMsg := HelloAckMsg{
+		helloMsg.Challenge,
+		keyShare.PublicKey().Bytes(),
+		h.node.nodeID,
+	}
+	ackSig, err := h.node.signMessage(ackMsg)
+	if err != nil {
+		return
+	}
+	session.Send(ComposeMsg(hHelloAck, ackMsg, ackSig))
+}
+
+// handleHelloAck authenticates the session once the peer signed our challenge
+// and derives the session key from both key shares,
+// unknown and duplicate identities are rejected
+func (h *NetworkingHub) handleHelloAck(session getty.Session, payload []byte, sig []byte) {
+	var ackMsg HelloAckMsg
+	err := decodeMsg(payload, &ackMsg)
+	if err != nil {
+		Logger.Errorf("Invalid hello ack from %s", session.RemoteAddr())
+		session.Close()
+		return
+	}
+	challenge, _ := session.GetAttribute(attrChallenge).([]byte)
+	if challenge == nil || !bytes.Equal(challenge, ackMsg.Challenge) {
+		Logger.Errorf("Hello ack from %s does not answer our challenge", session.RemoteAddr())
+		session.Close()
+		return
+	}
+	if ackMsg.NodeID == h.node.nodeID || !h.node.verifyReplicaMsg(hHelloAck, ackMsg.NodeID, ackMsg, sig) {
+		Logger.Errorf("Rejecting session from %s claiming to be replica %d", session.RemoteAddr(), ackMsg.NodeID)
+		session.Close()
+		return
+	}
+	macKey, err := h.sessionKey(session, ackMsg)
+	if err != nil {
+		Logger.Errorf("Key agreement with replica %d failed:%v", ackMsg.NodeID, err)
+		session.Close()
+		return
+	}
+	session.RemoveAttribute(attrChallenge)
+	session.SetAttribute(attrPeerID, ackMsg.NodeID)
+	if !h.addPeer(ackMsg.NodeID, session, macKey) {
+		Logger.Errorf("Replica %d is already connected, rejecting session from %s", ackMsg.NodeID, session.RemoteAddr())
+		session.Close()
+		return
+	}
+	Logger.Infof("Consensus session from %s authenticated as replica %d", session.RemoteAddr(), ackMsg.NodeID)
+}
+
+func (h *NetworkingHub) sessionKey(session getty.Session, ackMsg HelloAckMsg) ([]byte, error) {
+	keyShare, _ := session.GetAttribute(attrKeyShare).(*ecdh.PrivateKey)
+	if keyShare == nil {
+		return nil, fmt.Errorf("no key share")
+	}
+	peerShare, err := ecdh.X25519().NewPublicKey(ackMsg.KeyShare)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := keyShare.ECDH(peerShare)
+	if err != nil {
+		return nil, err
+	}
+	return deriveMacKey(shared, h.node.nodeID, ackMsg.NodeID), nil
+}
+
+// peerOf returns the replica a session is authenticated as
+func peerOf(session getty.Session) (int, bool) {
+	nodeID, ok := session.GetAttribute(attrPeerID).(int)
+	return nodeID, ok
+}
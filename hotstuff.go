@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/hex"
+	"sort"
+)
+
+// consensus protocols, selected with the protocol key of system config
+const (
+	protocolPBFT     = 0
+	protocolHotStuff = 1
+)
+
+func hotstuffMode() bool {
+	return SystemConfig["protocol"] == protocolHotStuff
+}
+
+// hotStuff runs chained HotStuff: every view has a single proposal, votes go to the
+// leader of the next view which aggregates them into the quorum certificate of its own
+// proposal, and a block commits once it heads a chain of three blocks certified in
+// consecutive views. Committed blocks execute through the same path as PBFT batches,
+// with the block height as sequence number, so checkpoints and state transfer are shared.
+// Its state is only touched by the ordering loop, node.View is the current view
+type hotStuff struct {
+	node            *Node
+	blocks          map[string]*Block // known blocks by hash, down to the last committed one
+	genesis         string
+	highQC          QuorumCert // highest certificate seen, the next proposal extends its block
+	lockedView      int        // a replica only votes for blocks justified at or above it
+	lastVotedView   int
+	committedHeight int
+	proposedView    int
+	votes           map[string]map[int]*SignedVoteMsg // block hash -> voter -> vote, at the next leader
+	newViews        map[int]map[int]bool              // view -> replicas that timed out into it
+}
+
+func newHotStuff(node *Node) *hotStuff {
+	genesis := &Block{-1, -1, "", QuorumCert{}, nil, -1}
+	hash := blockHash(genesis)
+	return &hotStuff{
+		node,
+		map[string]*Block{hash: genesis},
+		hash,
+		QuorumCert{-1, hash, nil},
+		-1,
+		-1,
+		-1,
+		-1,
+		make(map[string]map[int]*SignedVoteMsg),
+		make(map[int]map[int]bool),
+	}
+}
+
+// blockHash identifies a block by its position and its batch,
+// the votes of its certificate are not part of it
+func blockHash(block *Block) string {
+	header := struct {
+		ViewID      int
+		Height      int
+		Parent      string
+		JustifyView int
+		Batch       string
+		Proposer    int
+	}{
+		block.ViewID,
+		block.Height,
+		block.Parent,
+		block.Justify.ViewID,
+		batchDigest(block.Requests),
+		block.Proposer,
+	}
+	return hex.EncodeToString(generateDigest(header))
+}
+
+func (hs *hotStuff) view() int {
+	hs.node.mutex.Lock()
+	defer hs.node.mutex.Unlock()
+	return hs.node.View
+}
+
+func (hs *hotStuff) enterView(view int) {
+	hs.node.mutex.Lock()
+	defer hs.node.mutex.Unlock()
+	if view > hs.node.View {
+		hs.node.View = view
+	}
+}
+
+func (hs *hotStuff) dispatch(header HeaderMsg, payload []byte, sig []byte) {
+	switch header {
+	case hRequest:
+		hs.handleRequest(payload, sig)
+	case hHsProposal:
+		hs.handleProposal(payload, sig)
+	case hHsVote:
+		hs.handleVote(payload, sig)
+	case hHsNewView:
+		hs.handleNewView(payload, sig)
+	case hCheckpoint:
+		hs.node.handleCheckpoint(payload, sig)
+	}
+}
+
+func (hs *hotStuff) handleRequest(payload []byte, sig []byte) {
+	var request RequestMsg
+	err := decodeMsg(payload, &request)
+	if err != nil {
+		Logger.Error("Error in Request Handling:%v", err)
+		return
+	}
+	logHandleMsg(hRequest, request, request.ClientID)
+	node := hs.node
+	if node.admitRequest(request, sig) == nil {
+		return
+	}
+	// the request must execute before the timer expires, or the replica moves to the next view
+	node.startTimer()
+	hs.tryPropose()
+}
+
+// tryPropose proposes a block when this replica leads the current view and holds
+// the certificate of the previous view, or heard from a quorum that timed out into it
+func (hs *hotStuff) tryPropose() {
+	node := hs.node
+	view := hs.view()
+	if node.primaryOf(view) != node.nodeID || hs.proposedView >= view {
+		return
+	}
+	if hs.highQC.ViewID != view-1 && !node.quorum.isQuorum(nil, hs.newViews[view]) {
+		return
+	}
+	parent := hs.blocks[hs.highQC.BlockHash]
+	if parent == nil {
+		return
+	}
+	requests := hs.pendingRequests()
+	if len(requests) == 0 {
+		if !hs.uncommittedWork() {
+			return
+		}
+		// an empty block still certifies its ancestors, it carries a null request
+		requests = []SignedRequestMsg{{newNullRequest(view, parent.Height+1), []byte{}}}
+	}
+	block := Block{
+		view,
+		parent.Height + 1,
+		hs.highQC.BlockHash,
+		hs.highQC,
+		requests,
+		node.nodeID,
+	}
+	proposal := ProposalMsg{block, node.nodeID}
+	sig, err := node.signMessage(proposal)
+	if err != nil {
+		return
+	}
+	hs.proposedView = view
+	logBroadcastMsg(hHsProposal, proposal)
+	node.broadcast(ComposeMsg(hHsProposal, proposal, sig))
+	hs.processProposal(&block)
+}
+
+// pendingRequests are the requests this replica received that are neither executed
+// nor part of a block waiting to commit
+func (hs *hotStuff) pendingRequests() []SignedRequestMsg {
+	node := hs.node
+	proposed := make(map[string]bool)
+	for block := hs.blocks[hs.highQC.BlockHash]; block != nil && block.Height > hs.committedHeight; block = hs.blocks[block.Parent] {
+		for _, request := range block.Requests {
+			proposed[requestKey(&request.Request)] = true
+		}
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	requests := []SignedRequestMsg{}
+	for key, request := range node.requestPool {
+		if node.executed(&request.Request) || proposed[key] || isSystemRequest(&request.Request) {
+			continue
+		}
+		requests = append(requests, *request)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Request.Timestamp < requests[j].Request.Timestamp
+	})
+	if len(requests) > node.batchConfig.maxCount {
+		requests = requests[:node.batchConfig.maxCount]
+	}
+	return requests
+}
+
+// uncommittedWork tells whether one of the last three certified blocks carries requests,
+// they need more blocks on top of them to commit
+func (hs *hotStuff) uncommittedWork() bool {
+	block := hs.blocks[hs.highQC.BlockHash]
+	for i := 0; i < 3 && block != nil && block.Height > hs.committedHeight; i++ {
+		if !isNullRequest(&block.Requests[0].Request) {
+			return true
+		}
+		block = hs.blocks[block.Parent]
+	}
+	return false
+}
+
+func (hs *hotStuff) handleProposal(payload []byte, sig []byte) {
+	var proposal ProposalMsg
+	err := decodeMsg(payload, &proposal)
+	if err != nil {
+		Logger.Error("Error happened in handle Proposal:%v", err)
+		return
+	}
+	logHandleMsg(hHsProposal, proposal, proposal.NodeID)
+	hs.processProposal(&proposal.Block)
+}
+
+// processProposal stores a block, updates the chain with its certificate and votes
+// for it if it is safe to
+func (hs *hotStuff) processProposal(block *Block) {
+	node := hs.node
+	hash := blockHash(block)
+	if _, ok := hs.blocks[hash]; ok {
+		return
+	}
+	hs.blocks[hash] = block
+	hs.processQC(&block.Justify)
+
+	parent := hs.blocks[block.Parent]
+	if parent == nil || parent.Height+1 != block.Height {
+		// the replica missed an ancestor, it catches up through checkpoints
+		Logger.Warnf("Block %s of view %d does not extend a known block", hash, block.ViewID)
+		return
+	}
+	if block.ViewID < hs.view() || block.ViewID <= hs.lastVotedView || block.Justify.ViewID < hs.lockedView {
+		return
+	}
+	hs.lastVotedView = block.ViewID
+	hs.enterView(block.ViewID + 1)
+	voteMsg := VoteMsg{block.ViewID, hash, node.nodeID}
+	sig, err := node.signMessage(voteMsg)
+	if err != nil {
+		return
+	}
+	next := node.primaryOf(block.ViewID + 1)
+	if next == node.nodeID {
+		hs.addVote(&SignedVoteMsg{voteMsg, sig})
+	} else {
+		node.send(next, ComposeMsg(hHsVote, voteMsg, sig))
+	}
+	// votes may have reached this leader before the block
+	hs.tryFormQC(hash)
+	hs.tryPropose()
+}
+
+// processQC raises the highest certificate and the lock, and commits the block
+// that heads three blocks certified in consecutive views
+func (hs *hotStuff) processQC(qc *QuorumCert) {
+	if qc.ViewID > hs.highQC.ViewID {
+		hs.highQC = *qc
+		hs.enterView(qc.ViewID + 1)
+	}
+	b2 := hs.blocks[qc.BlockHash]
+	if b2 == nil {
+		return
+	}
+	b1 := hs.blocks[b2.Parent]
+	if b1 == nil {
+		return
+	}
+	if b1.ViewID > hs.lockedView {
+		hs.lockedView = b1.ViewID
+	}
+	b0 := hs.blocks[b1.Parent]
+	if b0 == nil {
+		return
+	}
+	if b2.ViewID == b1.ViewID+1 && b1.ViewID == b0.ViewID+1 {
+		hs.commitChain(b0)
+	}
+}
+
+// commitChain executes a committed block and its uncommitted ancestors in height order
+func (hs *hotStuff) commitChain(head *Block) {
+	node := hs.node
+	if head.Height <= hs.committedHeight {
+		return
+	}
+	chain := []*Block{}
+	block := head
+	for block != nil && block.Height > hs.committedHeight {
+		chain = append(chain, block)
+		block = hs.blocks[block.Parent]
+	}
+	if block == nil {
+		// the missing batches are fetched from the other replicas
+		node.requestStateTransfer()
+	}
+	hs.committedHeight = head.Height
+	for i := len(chain) - 1; i >= 0; i-- {
+		digest := batchDigest(chain[i].Requests)
+		node.mutex.Lock()
+		node.storeBatch(digest, chain[i].Requests)
+		node.mutex.Unlock()
+		node.commit(chain[i].Height, digest)
+	}
+	// blocks below the committed one cannot be extended anymore
+	for hash, block := range hs.blocks {
+		if block.Height < head.Height {
+			delete(hs.blocks, hash)
+		}
+	}
+	for view := range hs.newViews {
+		if view <= head.ViewID {
+			delete(hs.newViews, view)
+		}
+	}
+	for hash := range hs.votes {
+		if _, ok := hs.blocks[hash]; !ok {
+			delete(hs.votes, hash)
+		}
+	}
+}
+
+func (hs *hotStuff) handleVote(payload []byte, sig []byte) {
+	var voteMsg VoteMsg
+	err := decodeMsg(payload, &voteMsg)
+	if err != nil {
+		Logger.Error("Error happened in handle Vote:%v", err)
+		return
+	}
+	logHandleMsg(hHsVote, voteMsg, voteMsg.NodeID)
+	if hs.node.primaryOf(voteMsg.ViewID+1) != hs.node.nodeID || voteMsg.ViewID < hs.highQC.ViewID {
+		return
+	}
+	hs.node.latency.observe(hHsVote, voteMsg.BlockHash, voteMsg.NodeID, func(arrivals map[int]bool) bool {
+		return hs.node.quorum.isQuorum(nil, voters(arrivals, hs.node.nodeID))
+	})
+	hs.addVote(&SignedVoteMsg{voteMsg, sig})
+	hs.tryFormQC(voteMsg.BlockHash)
+	hs.tryPropose()
+}
+
+func (hs *hotStuff) addVote(vote *SignedVoteMsg) {
+	if hs.votes[vote.Vote.BlockHash] == nil {
+		hs.votes[vote.Vote.BlockHash] = make(map[int]*SignedVoteMsg)
+	}
+	hs.votes[vote.Vote.BlockHash][vote.Vote.NodeID] = vote
+}
+
+// tryFormQC aggregates a quorum of votes for a known block into its certificate,
+// the replicas vote with their base weights
+func (hs *hotStuff) tryFormQC(hash string) {
+	block := hs.blocks[hash]
+	if block == nil || hs.highQC.ViewID >= block.ViewID {
+		return
+	}
+	votes := []SignedVoteMsg{}
+	voted := make(map[int]bool)
+	for _, vote := range hs.votes[hash] {
+		if vote.Vote.ViewID == block.ViewID {
+			votes = append(votes, *vote)
+			voted[vote.Vote.NodeID] = true
+		}
+	}
+	if !hs.node.quorum.isQuorum(nil, voted) {
+		return
+	}
+	sort.Slice(votes, func(i, j int) bool {
+		return votes[i].Vote.NodeID < votes[j].Vote.NodeID
+	})
+	delete(hs.votes, hash)
+	hs.processQC(&QuorumCert{block.ViewID, hash, votes})
+}
+
+// localTimeout moves to the next view and hands the highest certificate to its leader
+func (hs *hotStuff) localTimeout() {
+	node := hs.node
+	view := hs.view() + 1
+	hs.enterView(view)
+	Logger.Warnf("Timer expired, moving to view %d", view)
+	newViewMsg := HsNewViewMsg{view, hs.highQC, node.nodeID}
+	if node.hasPendingRequests() {
+		node.startTimer()
+	}
+	leader := node.primaryOf(view)
+	if leader == node.nodeID {
+		hs.addNewView(&newViewMsg)
+		return
+	}
+	sig, err := node.signMessage(newViewMsg)
+	if err != nil {
+		return
+	}
+	node.send(leader, ComposeMsg(hHsNewView, newViewMsg, sig))
+}
+
+func (hs *hotStuff) handleNewView(payload []byte, sig []byte) {
+	var newViewMsg HsNewViewMsg
+	err := decodeMsg(payload, &newViewMsg)
+	if err != nil {
+		Logger.Error("Error happened in handle HsNewView:%v", err)
+		return
+	}
+	logHandleMsg(hHsNewView, newViewMsg, newViewMsg.NodeID)
+	if hs.node.primaryOf(newViewMsg.ViewID) != hs.node.nodeID || newViewMsg.ViewID < hs.view() {
+		return
+	}
+	hs.addNewView(&newViewMsg)
+}
+
+func (hs *hotStuff) addNewView(newViewMsg *HsNewViewMsg) {
+	hs.processQC(&newViewMsg.HighQC)
+	if hs.newViews[newViewMsg.ViewID] == nil {
+		hs.newViews[newViewMsg.ViewID] = make(map[int]bool)
+	}
+	hs.newViews[newViewMsg.ViewID][newViewMsg.NodeID] = true
+	if hs.node.quorum.isQuorum(nil, hs.newViews[newViewMsg.ViewID]) {
+		hs.enterView(newViewMsg.ViewID)
+	}
+	hs.tryPropose()
+}
+
+// verifyProposal checks the leader's signature, the certificate the block extends and its batch
+func (node *Node) verifyProposal(proposal *ProposalMsg, sig []byte) bool {
+	block := &proposal.Block
+	leader := node.primaryOf(block.ViewID)
+	if proposal.NodeID != leader || block.Proposer != leader {
+		node.rejectReplicaMsg(hHsProposal, proposal.NodeID, "not the leader")
+		return false
+	}
+	if !node.verifyReplicaMsg(hHsProposal, leader, *proposal, sig) {
+		return false
+	}
+	if block.Parent != block.Justify.BlockHash || block.Justify.ViewID >= block.ViewID {
+		node.rejectReplicaMsg(hHsProposal, leader, "block does not extend its certificate")
+		return false
+	}
+	if !node.verifyQC(&block.Justify) {
+		node.rejectReplicaMsg(hHsProposal, leader, "invalid certificate")
+		return false
+	}
+	err := node.verifyBatch(batchDigest(block.Requests), block.Requests)
+	if err != nil {
+		node.rejectReplicaMsg(hHsProposal, leader, err.Error())
+		return false
+	}
+	return true
+}
+
+// verifyQC checks a quorum of signed votes for the certified block, the genesis certificate has none
+func (node *Node) verifyQC(qc *QuorumCert) bool {
+	if qc.ViewID == -1 && qc.BlockHash == node.hotstuff.genesis && len(qc.Votes) == 0 {
+		return true
+	}
+	voters := make(map[int]bool)
+	for _, vote := range qc.Votes {
+		if vote.Vote.ViewID != qc.ViewID || vote.Vote.BlockHash != qc.BlockHash {
+			return false
+		}
+		pubkey := node.findNodePubkey(vote.Vote.NodeID)
+		if pubkey == nil || !verifySignatrue(vote.Vote, vote.Signature, pubkey) {
+			return false
+		}
+		voters[vote.Vote.NodeID] = true
+	}
+	return node.quorum.isQuorum(nil, voters)
+}
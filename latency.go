@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// weight of the newest sample in the rolling scores
+const latencyAlpha = 0.2
+
+// a replica whose send queue stays more than half full does not keep up either
+const queueFillThreshold = 0.5
+
+// StragglerEvent is emitted when a replica starts or stops being classified as a straggler
+type StragglerEvent struct {
+	NodeID    int
+	Straggler bool
+	Score     time.Duration
+	QueueFill float64
+}
+
+// LatencyMonitor measures how late the votes of every replica arrive relative to the
+// quorum: a vote that arrives before the quorum forms scores 0, a later one the time
+// since the quorum formed, a missing one the time until its round closed. The rolling
+// score of a replica is the moving average of its lateness
+type LatencyMonitor struct {
+	mu         sync.Mutex
+	self       int
+	replicas   []int
+	window     time.Duration // a round closes this long after it opened
+	threshold  time.Duration // score above which a replica is a straggler
+	rounds     map[string]*voteRound
+	scores     map[int]float64 // in milliseconds
+	queueFills map[int]float64
+	stragglers map[int]bool
+	events     chan StragglerEvent
+}
+
+// voteRound follows the votes for a single quorum
+type voteRound struct {
+	opened   time.Time
+	quorumAt time.Time
+	quorum   func(map[int]bool) bool
+	arrivals map[int]bool
+}
+
+// newLatencyMonitor reads the window and the threshold from system config, in milliseconds
+func newLatencyMonitor(nodeID int) *LatencyMonitor {
+	replicas := []int{}
+	for _, replica := range Replicas {
+		replicas = append(replicas, replica.nodeID)
+	}
+	window := time.Duration(SystemConfig["stragglerWindow"]) * time.Millisecond
+	if window <= 0 {
+		window = time.Second
+	}
+	threshold := time.Duration(SystemConfig["stragglerThreshold"]) * time.Millisecond
+	return NewLatencyMonitor(nodeID, replicas, window, threshold)
+}
+
+func NewLatencyMonitor(self int, replicas []int, window time.Duration, threshold time.Duration) *LatencyMonitor {
+	return &LatencyMonitor{
+		self:       self,
+		replicas:   replicas,
+		window:     window,
+		threshold:  threshold,
+		rounds:     make(map[string]*voteRound),
+		scores:     make(map[int]float64),
+		queueFills: make(map[int]float64),
+		stragglers: make(map[int]bool),
+		events:     make(chan StragglerEvent, 64),
+	}
+}
+
+// observe records the vote of sender for digest, quorum tells whether the votes
+// received from the other replicas form the quorum
+func (m *LatencyMonitor) observe(header HeaderMsg, digest string, sender int, quorum func(map[int]bool) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	key := string(header) + digest
+	round := m.rounds[key]
+	if round == nil {
+		round = &voteRound{now, time.Time{}, quorum, make(map[int]bool)}
+		m.rounds[key] = round
+	}
+	if round.arrivals[sender] {
+		return
+	}
+	round.arrivals[sender] = true
+	if !round.quorumAt.IsZero() {
+		m.sample(sender, now.Sub(round.quorumAt))
+	} else if round.quorum(round.arrivals) {
+		round.quorumAt = now
+		for nodeID := range round.arrivals {
+			m.sample(nodeID, 0)
+		}
+	}
+	if len(round.arrivals) == len(m.replicas)-1 {
+		delete(m.rounds, key)
+	}
+}
+
+// must be called with m.mu held
+func (m *LatencyMonitor) sample(nodeID int, lateness time.Duration) {
+	ms := float64(lateness) / float64(time.Millisecond)
+	m.scores[nodeID] = (1-latencyAlpha)*m.scores[nodeID] + latencyAlpha*ms
+}
+
+// sweep closes the rounds older than the window, samples the send queues and
+// classifies the replicas, queueFill reports the send queue of a connected replica
+func (m *LatencyMonitor) sweep(queueFill func(int) (float64, bool)) {
+	m.mu.Lock()
+	now := time.Now()
+	for key, round := range m.rounds {
+		if now.Sub(round.opened) < m.window {
+			continue
+		}
+		if !round.quorumAt.IsZero() {
+			for _, nodeID := range m.replicas {
+				if nodeID != m.self && !round.arrivals[nodeID] {
+					m.sample(nodeID, now.Sub(round.quorumAt))
+				}
+			}
+		}
+		delete(m.rounds, key)
+	}
+	events := []StragglerEvent{}
+	for _, nodeID := range m.replicas {
+		if nodeID == m.self {
+			continue
+		}
+		if fill, ok := queueFill(nodeID); ok {
+			m.queueFills[nodeID] = (1-latencyAlpha)*m.queueFills[nodeID] + latencyAlpha*fill
+		}
+		score := time.Duration(m.scores[nodeID] * float64(time.Millisecond))
+		straggler := score > m.threshold || m.queueFills[nodeID] > queueFillThreshold
+		if straggler != m.stragglers[nodeID] {
+			m.stragglers[nodeID] = straggler
+			events = append(events, StragglerEvent{nodeID, straggler, score, m.queueFills[nodeID]})
+		}
+	}
+	m.mu.Unlock()
+
+	for _, event := range events {
+		if event.Straggler {
+			Logger.Warnf("Replica %d is a straggler: score %v, send queue %.0f%% full", event.NodeID, event.Score, event.QueueFill*100)
+		} else {
+			Logger.Infof("Replica %d caught up: score %v, send queue %.0f%% full", event.NodeID, event.Score, event.QueueFill*100)
+		}
+		select {
+		case m.events <- event:
+		default:
+			// nobody is listening, the event is only logged
+		}
+	}
+}
+
+// Score returns the rolling lateness of a replica's votes
+func (m *LatencyMonitor) Score(nodeID int) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Duration(m.scores[nodeID] * float64(time.Millisecond))
+}
+
+// IsStraggler tells whether a replica was classified as a straggler at the last sweep
+func (m *LatencyMonitor) IsStraggler(nodeID int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stragglers[nodeID]
+}
+
+// Events delivers a StragglerEvent every time the classification of a replica changes
+func (m *LatencyMonitor) Events() <-chan StragglerEvent {
+	return m.events
+}
+
+func (m *LatencyMonitor) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sb strings.Builder
+	nodeIDs := append([]int{}, m.replicas...)
+	sort.Ints(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		if nodeID == m.self {
+			continue
+		}
+		score := time.Duration(m.scores[nodeID] * float64(time.Millisecond))
+		fmt.Fprintf(&sb, "replica %d: score=%v queue=%.0f%% straggler=%v\n",
+			nodeID, score, m.queueFills[nodeID]*100, m.stragglers[nodeID])
+	}
+	return sb.String()
+}
+
+// monitorStragglers sweeps the latency monitor until the process exits
+func (node *Node) monitorStragglers() {
+	ticker := time.NewTicker(node.latency.window)
+	defer ticker.Stop()
+	for range ticker.C {
+		node.latency.sweep(node.hub.queueFill)
+	}
+}
+
+// LatencyMonitor exposes the straggler scores of the other replicas
+func (node *Node) LatencyMonitor() *LatencyMonitor {
+	return node.latency
+}
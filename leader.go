@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+)
+
+// leader selection policies, selected with the leaderPolicy key of system config
+const (
+	leaderRoundRobin     = 0
+	leaderSkipStragglers = 1
+)
+
+// the primary must keep up with this fraction of the best proposal rate seen,
+// the bar drops by the same factor after every view change it triggers
+const proposalRateFactor = 0.9
+
+// nextView is the view a replica moves to when it gives up on view. Skipping the views
+// led by stragglers is a local decision, replicas that disagree converge because a
+// replica joins the smallest view f+1 others moved to. At most f views are skipped,
+// so a quorum of slow replicas cannot keep every view change going
+func (node *Node) nextView(view int) int {
+	next := view + 1
+	if SystemConfig["leaderPolicy"] != leaderSkipStragglers {
+		return next
+	}
+	for skipped := 0; skipped < node.countTolerateFaultNode(); skipped++ {
+		primary := node.primaryOf(next)
+		if primary == node.nodeID || !node.latency.IsStraggler(primary) {
+			break
+		}
+		Logger.Infof("Skipping view %d, its primary %d is a straggler", next, primary)
+		next++
+	}
+	return next
+}
+
+// monitorPrimary asks the ordering loop to check the primary's proposal rate
+// at the end of every window, when enabled by the monitorPrimary key of system config
+func (node *Node) monitorPrimary() {
+	if SystemConfig["monitorPrimary"] != 1 {
+		return
+	}
+	ticker := time.NewTicker(node.rateWindow())
+	defer ticker.Stop()
+	for range ticker.C {
+		select {
+		case node.rateQueue <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (node *Node) rateWindow() time.Duration {
+	window := time.Duration(SystemConfig["rateWindow"]) * time.Millisecond
+	if window <= 0 {
+		window = time.Second
+	}
+	return window
+}
+
+// checkProposalRate replaces a primary that orders fewer batches than expected while
+// requests are waiting, like Aardvark: a slow primary that never lets the request timer
+// expire cannot degrade the throughput for long. The first window of a view is a grace period
+func (node *Node) checkProposalRate() {
+	node.mutex.Lock()
+	count := node.proposalCount
+	node.proposalCount = 0
+	view := node.View
+	fresh := node.rateView != view
+	node.rateView = view
+	skip := fresh || node.viewChanging || node.findPrimaryNode() == node.nodeID || hotstuffMode()
+	rate := float64(count) / node.rateWindow().Seconds()
+	if !skip && rate > node.peakRate {
+		node.peakRate = rate
+	}
+	required := proposalRateFactor * node.peakRate
+	if floor := float64(SystemConfig["minProposalRate"]); required < floor {
+		required = floor
+	}
+	wasPending := node.pendingAtCheck
+	node.mutex.Unlock()
+	pending := node.hasPendingRequests()
+	node.mutex.Lock()
+	node.pendingAtCheck = pending
+	node.mutex.Unlock()
+	// only a window with requests waiting all along says something about the primary
+	if skip || !wasPending || !pending || rate >= required {
+		return
+	}
+	node.mutex.Lock()
+	node.peakRate *= proposalRateFactor
+	next := node.nextView(view)
+	node.mutex.Unlock()
+	Logger.Warnf("Primary %d proposed %.1f batches/s in view %d, %.1f expected, moving to view %d",
+		node.primaryOf(view), rate, view, required, next)
+	node.startViewChange(next)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -8,14 +9,29 @@ import (
 
 const headerLength = 12
 
+// a message ends with its signature or authenticator and the length of it
+const authLenLength = 2
+
 type HeaderMsg string
 
 const (
-	hRequest    HeaderMsg = "Request"
-	hPrePrepare HeaderMsg = "PrePrepare"
-	hPrepare    HeaderMsg = "Prepare"
-	hCommit     HeaderMsg = "Commit"
-	hReply      HeaderMsg = "Reply"
+	hRequest     HeaderMsg = "Request"
+	hPrePrepare  HeaderMsg = "PrePrepare"
+	hPrepare     HeaderMsg = "Prepare"
+	hCommit      HeaderMsg = "Commit"
+	hReply       HeaderMsg = "Reply"
+	hViewChange  HeaderMsg = "ViewChange"
+	hNewView     HeaderMsg = "NewView"
+	hCheckpoint  HeaderMsg = "Checkpoint"
+	hFetchState  HeaderMsg = "FetchState"
+	hState       HeaderMsg = "State"
+	hHello       HeaderMsg = "Hello"
+	hHelloAck    HeaderMsg = "HelloAck"
+	hPrepareCert HeaderMsg = "PrepareCert"
+	hCommitCert  HeaderMsg = "CommitCert"
+	hHsProposal  HeaderMsg = "HsProposal"
+	hHsVote      HeaderMsg = "HsVote"
+	hHsNewView   HeaderMsg = "HsNewView"
 )
 
 type Msg interface {
@@ -35,12 +51,19 @@ func (msg RequestMsg) String() string {
 	return string(bmsg) + "\n"
 }
 
-// <<PRE-PREPARE,v,n,d>,m>
+// <REQUEST, o, t, c> with the client's signature, so backups can check every request of a batch
+type SignedRequestMsg struct {
+	Request   RequestMsg `json:"request"`
+	Signature []byte     `json:"signature"`
+}
+
+// <<PRE-PREPARE,v,n,d>,B>: the batch B is ordered under a single sequence number
 type PrePrepareMsg struct {
-	Request    RequestMsg `json:"request"`
-	Digest     string     `json:"digest"`
-	ViewID     int        `json:"viewID"`
-	SequenceID int        `json:"sequenceID"`
+	Requests   []SignedRequestMsg `json:"requests"`
+	Digest     string             `json:"digest"`
+	ViewID     int                `json:"viewID"`
+	SequenceID int                `json:"sequenceID"`
+	Weights    []int              `json:"weights,omitempty"` // voting weights by node id, nil for the base weights
 }
 
 func (msg PrePrepareMsg) String() string {
@@ -81,6 +104,7 @@ type ReplyMsg struct {
 	ClientID  int    `json:"clientID"`
 	NodeID    int    `json:"nodeid"`
 	Result    string `json:"result"`
+	FastPath  bool   `json:"fastPath,omitempty"` // the replica committed the request on the fast path
 }
 
 func (msg ReplyMsg) String() string {
@@ -88,6 +112,225 @@ func (msg ReplyMsg) String() string {
 	return string(bmsg) + "\n"
 }
 
+// <PRE-PREPARE,v,n,d> with the primary's signature, kept as proof for view changes
+type SignedPrePrepareMsg struct {
+	PrePrepare PrePrepareMsg `json:"prePrepare"`
+	Signature  []byte        `json:"signature"`
+}
+
+// <PREPARE, v, n, d, i> with the sender's signature
+type SignedPrepareMsg struct {
+	Prepare   PrepareMsg `json:"prepare"`
+	Signature []byte     `json:"signature"`
+}
+
+// <COMMIT, v, n, d, i> with the sender's signature
+type SignedCommitMsg struct {
+	Commit    CommitMsg `json:"commit"`
+	Signature []byte    `json:"signature"`
+}
+
+// <PREPARE-CERT, v, n, d, P, i>: the collector i aggregates a quorum of prepares P
+// it received for a pre-prepare, replacing the all-to-all exchange of prepares
+type PrepareCertMsg struct {
+	Digest     string             `json:"digest"`
+	ViewID     int                `json:"viewID"`
+	SequenceID int                `json:"sequenceID"`
+	Prepares   []SignedPrepareMsg `json:"prepares"`
+	NodeID     int                `json:"nodeid"`
+}
+
+func (msg PrepareCertMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+// <COMMIT-CERT, v, n, d, C, i>: the collector i aggregates a quorum of commits C
+type CommitCertMsg struct {
+	Digest     string            `json:"digest"`
+	ViewID     int               `json:"viewID"`
+	SequenceID int               `json:"sequenceID"`
+	Commits    []SignedCommitMsg `json:"commits"`
+	NodeID     int               `json:"nodeid"`
+}
+
+func (msg CommitCertMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+// prepared certificate: a pre-prepare and the matching prepares that complete its quorum
+type PreparedCert struct {
+	PrePrepare SignedPrePrepareMsg `json:"prePrepare"`
+	Prepares   []SignedPrepareMsg  `json:"prepares"`
+}
+
+// <CHECKPOINT, n, d, i>
+type CheckpointMsg struct {
+	SequenceID int    `json:"sequenceID"`
+	Digest     string `json:"digest"`
+	NodeID     int    `json:"nodeid"`
+}
+
+func (msg CheckpointMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+// <CHECKPOINT, n, d, i> with the sender's signature
+type SignedCheckpointMsg struct {
+	Checkpoint CheckpointMsg `json:"checkpoint"`
+	Signature  []byte        `json:"signature"`
+}
+
+// <VIEW-CHANGE, v+1, n, C, P, i>
+type ViewChangeMsg struct {
+	ViewID          int                   `json:"viewID"`
+	StableSeqID     int                   `json:"stableSequenceID"`
+	CheckpointProof []SignedCheckpointMsg `json:"checkpointProof"`
+	PreparedCerts   []PreparedCert        `json:"preparedCerts"`
+	PrePrepared     []SignedPrePrepareMsg `json:"prePrepared,omitempty"` // accepted pre-prepares, with the fast path
+	NodeID          int                   `json:"nodeid"`
+}
+
+func (msg ViewChangeMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+// <VIEW-CHANGE, v+1, n, C, P, i> with the sender's signature
+type SignedViewChangeMsg struct {
+	ViewChange ViewChangeMsg `json:"viewChange"`
+	Signature  []byte        `json:"signature"`
+}
+
+// <NEW-VIEW, v+1, V, O>
+type NewViewMsg struct {
+	ViewID      int                   `json:"viewID"`
+	ViewChanges []SignedViewChangeMsg `json:"viewChanges"`
+	PrePrepares []SignedPrePrepareMsg `json:"prePrepares"`
+	NodeID      int                   `json:"nodeid"`
+}
+
+func (msg NewViewMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+// <FETCH-STATE, n, i>: ask for everything after the last executed sequence number n
+type FetchStateMsg struct {
+	LastExecuted int `json:"lastExecuted"`
+	NodeID       int `json:"nodeid"`
+}
+
+func (msg FetchStateMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+type CommittedBatch struct {
+	SequenceID int                `json:"sequenceID"`
+	Requests   []SignedRequestMsg `json:"requests"`
+}
+
+// <STATE, n, C, s, B, i>: stable checkpoint n with its proof C and snapshot s,
+// followed by the batches B executed after it
+type StateMsg struct {
+	StableSeqID     int                   `json:"stableSequenceID"`
+	CheckpointProof []SignedCheckpointMsg `json:"checkpointProof"`
+	Snapshot        []byte                `json:"snapshot"`
+	Batches         []CommittedBatch      `json:"batches"`
+	NodeID          int                   `json:"nodeid"`
+}
+
+func (msg StateMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+// <HELLO, c, i>: replica i opens a consensus session with the challenge c
+type HelloMsg struct {
+	Challenge []byte `json:"challenge"`
+	NodeID    int    `json:"nodeid"`
+}
+
+func (msg HelloMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+// <HELLO-ACK, c, k, i>: replica i proves its identity by signing the peer's challenge c,
+// together with its key share k for the session key
+type HelloAckMsg struct {
+	Challenge []byte `json:"challenge"`
+	KeyShare  []byte `json:"keyShare"`
+	NodeID    int    `json:"nodeid"`
+}
+
+func (msg HelloAckMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+// <VOTE, v, h, i>: replica i votes for the block with hash h proposed in view v
+type VoteMsg struct {
+	ViewID    int    `json:"viewID"`
+	BlockHash string `json:"blockHash"`
+	NodeID    int    `json:"nodeid"`
+}
+
+func (msg VoteMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+// <VOTE, v, h, i> with the sender's signature
+type SignedVoteMsg struct {
+	Vote      VoteMsg `json:"vote"`
+	Signature []byte  `json:"signature"`
+}
+
+// quorum certificate: a quorum of votes for the block with hash h proposed in view v
+type QuorumCert struct {
+	ViewID    int             `json:"viewID"`
+	BlockHash string          `json:"blockHash"`
+	Votes     []SignedVoteMsg `json:"votes"`
+}
+
+// a block of the chained protocol extends its parent, the block certified by Justify
+type Block struct {
+	ViewID   int                `json:"viewID"`
+	Height   int                `json:"height"`
+	Parent   string             `json:"parent"`
+	Justify  QuorumCert         `json:"justify"`
+	Requests []SignedRequestMsg `json:"requests"`
+	Proposer int                `json:"proposer"`
+}
+
+// <PROPOSAL, b, i>: the leader i of the block's view proposes b
+type ProposalMsg struct {
+	Block  Block `json:"block"`
+	NodeID int   `json:"nodeid"`
+}
+
+func (msg ProposalMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
+// <NEW-VIEW, v, qc, i>: replica i timed out and hands its highest certificate qc
+// to the leader of view v
+type HsNewViewMsg struct {
+	ViewID int        `json:"viewID"`
+	HighQC QuorumCert `json:"highQC"`
+	NodeID int        `json:"nodeid"`
+}
+
+func (msg HsNewViewMsg) String() string {
+	bmsg, _ := json.MarshalIndent(msg, "", "	")
+	return string(bmsg) + "\n"
+}
+
 type Request struct {
 	Message string `json:"message"`
 	Digest  string `json:"digest"`
@@ -111,7 +354,7 @@ func ComposeMsg(header HeaderMsg, payload interface{}, sig []byte) []byte {
 	}
 	switch t.Kind() {
 	case reflect.Struct:
-		bpayload, err = json.Marshal(payload)
+		bpayload, err = encodeMsg(payload)
 		if err != nil {
 			panic(err)
 		}
@@ -125,12 +368,14 @@ func ComposeMsg(header HeaderMsg, payload interface{}, sig []byte) []byte {
 	for i, h := range []byte(header) {
 		b[i] = h
 	}
-	res := make([]byte, headerLength+len(bpayload)+len(sig))
+	// the signature or authenticator is followed by its length
+	res := make([]byte, headerLength+len(bpayload)+len(sig)+authLenLength)
 	copy(res[:headerLength], b)
 	copy(res[headerLength:], bpayload)
 	if len(sig) > 0 {
 		copy(res[headerLength+len(bpayload):], sig)
 	}
+	binary.BigEndian.PutUint16(res[len(res)-authLenLength:], uint16(len(sig)))
 	return res
 }
 
@@ -138,6 +383,9 @@ func SplitMsg(bmsg []byte) (HeaderMsg, []byte, []byte) {
 	var header HeaderMsg
 	var payload []byte
 	var signature []byte
+	if len(bmsg) < headerLength {
+		return header, payload, signature
+	}
 	hbyte := bmsg[:headerLength]
 	hhbyte := make([]byte, 0)
 	for _, h := range hbyte {
@@ -147,12 +395,18 @@ func SplitMsg(bmsg []byte) (HeaderMsg, []byte, []byte) {
 	}
 	header = HeaderMsg(hhbyte)
 	switch header {
-	case hRequest, hPrePrepare, hPrepare, hCommit:
-		payload = bmsg[headerLength : len(bmsg)-SignatureLength]
-		signature = bmsg[len(bmsg)-SignatureLength:]
-	case hReply:
-		payload = bmsg[headerLength:]
-		signature = []byte{}
+	case hRequest, hPrePrepare, hPrepare, hCommit, hReply, hViewChange, hNewView, hCheckpoint, hFetchState, hState, hHello, hHelloAck,
+		hPrepareCert, hCommitCert, hHsProposal, hHsVote, hHsNewView:
+		if len(bmsg) < headerLength+authLenLength {
+			return "", nil, nil
+		}
+		end := len(bmsg) - authLenLength
+		authLen := int(binary.BigEndian.Uint16(bmsg[end:]))
+		if end-headerLength < authLen {
+			return "", nil, nil
+		}
+		payload = bmsg[headerLength : end-authLen]
+		signature = bmsg[end-authLen : end]
 	}
 	return header, payload, signature
 }
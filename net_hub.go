@@ -2,24 +2,28 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	getty "github.com/apache/dubbo-getty"
 )
 
 type NetworkingHub struct {
-	node                 *Node // Use the fully qualified type name
-	consensusConnections []*getty.Session
-	//stateTransferConnections []*getty.Session
-	clientConnections []*getty.Session
-	mu                sync.Mutex // Protects connections
+	node                     *Node         // Use the fully qualified type name
+	consensusConnections     map[int]*peer // keyed by replica ID, once authenticated
+	stateTransferConnections []getty.Session
+	clientConnections        map[int]*clientSession // keyed by client ID
+	mu                       sync.Mutex             // Protects connections
 }
 
 func NewNetworkingHub(node *Node) *NetworkingHub {
 	hub := &NetworkingHub{
-		node:                 node,
-		consensusConnections: []*getty.Session{},
-		mu:                   sync.Mutex{},
+		node:                     node,
+		consensusConnections:     make(map[int]*peer),
+		stateTransferConnections: []getty.Session{},
+		clientConnections:        make(map[int]*clientSession),
+		mu:                       sync.Mutex{},
 	}
 	node.hub = hub
 
@@ -42,11 +46,8 @@ func (h *NetworkingHub) establishConsensusConnections() {
 			// establish getty sessions
 			address := fmt.Sprintf("%s:%d", peer.ip, peer.consensusPort)
 			Logger.Infof("Establishing connection to %s", address)
-			client := getty.NewTCPClient(
-				getty.WithServerAddress(address),
-				getty.WithConnectionNumber(1),  // Assuming one connection per peer for simplicity
-				getty.WithReconnectInterval(3), //this should be setup in the system config file
-			)
+			// Assuming one connection per peer for simplicity
+			client := getty.NewTCPClient(h.clientOptions(address, tlsConsensus)...)
 
 			client.RunEventLoop(func(session getty.Session) error {
 
@@ -66,8 +67,7 @@ func (h *NetworkingHub) establishConsensusConnections() {
 func (h *NetworkingHub) listenForConsensusConnections() {
 
 	Logger.Infof("Listening for consensus connections on port %d", h.node.info.consensusPort)
-	server := getty.NewTCPServer(
-		getty.WithLocalAddress(fmt.Sprintf(":%d", h.node.info.consensusPort)))
+	server := getty.NewTCPServer(h.serverOptions(h.node.info.consensusPort, tlsConsensus, isReplicaKey)...)
 
 	server.RunEventLoop(func(session getty.Session) error {
 		/*
@@ -88,13 +88,45 @@ func (h *NetworkingHub) listenForConsensusConnections() {
 	})
 }
 
-func (h *NetworkingHub) establishStateTransferConnections() {}
-func (h *NetworkingHub) listenForStateTransferConnections() {}
+func (h *NetworkingHub) establishStateTransferConnections() {
+	for _, peer := range h.node.knownNodes {
+		if h.node.nodeID > peer.nodeID {
+			address := fmt.Sprintf("%s:%d", peer.ip, peer.stateTransferPort)
+			Logger.Infof("Establishing state transfer connection to %s", address)
+			client := getty.NewTCPClient(h.clientOptions(address, tlsStateTransfer)...)
+
+			client.RunEventLoop(func(session getty.Session) error {
+				session.SetEventListener(
+					&StateTransferSessionHandler{
+						hub: h,
+					},
+				)
+				session.SetPkgHandler(&DefaultPackageHandler{})
+
+				return nil
+			})
+		}
+	}
+}
+
+func (h *NetworkingHub) listenForStateTransferConnections() {
+	Logger.Infof("Listening for state transfer connections on port %d", h.node.info.stateTransferPort)
+	server := getty.NewTCPServer(h.serverOptions(h.node.info.stateTransferPort, tlsStateTransfer, isReplicaKey)...)
+
+	server.RunEventLoop(func(session getty.Session) error {
+		session.SetEventListener(
+			&StateTransferSessionHandler{
+				hub: h,
+			},
+		)
+		session.SetPkgHandler(&DefaultPackageHandler{})
+
+		return nil
+	})
+}
 
-// now we only support one client connection
 func (h *NetworkingHub) listenForClientConnections() {
-	server := getty.NewTCPServer(
-		getty.WithLocalAddress(fmt.Sprintf(":%d", h.node.info.clientPort)))
+	server := getty.NewTCPServer(h.serverOptions(h.node.info.clientPort, tlsClient, isClientKey)...)
 
 	server.RunEventLoop(func(session getty.Session) error {
 		session.SetEventListener(
@@ -108,34 +140,195 @@ func (h *NetworkingHub) listenForClientConnections() {
 	})
 }
 
-//func (h *NetworkingHub) sendConsensusMsg(msg ConsensusMsg, dest int) {}
-//func (h *NetworkingHub) broadcastConsensusMsg(msg ConsensusMsg)      {}
+func (h *NetworkingHub) broadcastStateTransfer(bytes []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-/*
-func (h *NetworkingHub) sendStateTransferMsg(msg StateTransferMsg, dest int) {
-	// Send the message one peer
+	for _, session := range h.stateTransferConnections {
+		session.Send(bytes)
+	}
 }
 
-func (h *NetworkingHub) broadcastStateTransferMsg(msg StateTransferMsg) {
-	// Broadcast the message to all peers
+// addPeer registers the authenticated session of a replica, it fails if the replica
+// is already connected on another session
+func (h *NetworkingHub) addPeer(nodeID int, session getty.Session, macKey []byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	existing, ok := h.consensusConnections[nodeID]
+	if ok && existing.session != session && !existing.session.IsClosed() {
+		return false
+	}
+	if ok {
+		existing.stop()
+	}
+	h.consensusConnections[nodeID] = newPeer(nodeID, session, macKey, SystemConfig["maxSendQ"])
+	return true
 }
-*/
 
+// macKey returns the session key shared with a replica, nil while it is not connected
+func (h *NetworkingHub) macKey(nodeID int) []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.consensusConnections[nodeID]
+	if !ok {
+		return nil
+	}
+	return p.macKey
+}
+
+// queueFill is the fraction of the send queue to a replica waiting to be sent,
+// false while the replica is not connected
+func (h *NetworkingHub) queueFill(nodeID int) (float64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.consensusConnections[nodeID]
+	if !ok {
+		return 0, false
+	}
+	return float64(len(p.queue)) / float64(cap(p.queue)), true
+}
+
+func (h *NetworkingHub) removePeer(nodeID int, session getty.Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.consensusConnections[nodeID]
+	if ok && p.session == session {
+		p.stop()
+		delete(h.consensusConnections, nodeID)
+	}
+}
+
+// broadcast only queues the message, h.mu is never held while sending
 func (h *NetworkingHub) broadcast(bytes []byte) {
-	// do we need to lock the hub here?
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	for _, session := range h.consensusConnections {
-		s := *session
-		s.Send(bytes)
+	for _, p := range h.consensusConnections {
+		p.enqueue(bytes)
+	}
+}
+
+// send delivers a message to a single replica
+func (h *NetworkingHub) send(nodeID int, bytes []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.consensusConnections[nodeID]
+	if !ok {
+		Logger.Warnf("No connection to replica %d, dropping message", nodeID)
+		return
+	}
+	p.enqueue(bytes)
+}
+
+// multicast delivers a message to a subset of the replicas
+func (h *NetworkingHub) multicast(nodeIDs []int, bytes []byte) {
+	for _, nodeID := range nodeIDs {
+		h.send(nodeID, bytes)
 	}
 }
 
-func (h *NetworkingHub) sendToClient(bytes []byte) {
-	// do we need to lock the hub here?
-	for _, session := range h.clientConnections {
-		s := *session
-		s.Send(bytes)
+// fastestPeers returns the connected replicas with the best straggler scores,
+// as few as it takes for quorum to hold, or all of them
+func (h *NetworkingHub) fastestPeers(quorum func(map[int]bool) bool) []int {
+	h.mu.Lock()
+	peers := []int{}
+	for nodeID := range h.consensusConnections {
+		peers = append(peers, nodeID)
+	}
+	h.mu.Unlock()
+	scores := make(map[int]time.Duration, len(peers))
+	for _, nodeID := range peers {
+		scores[nodeID] = h.node.latency.Score(nodeID)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if scores[peers[i]] != scores[peers[j]] {
+			return scores[peers[i]] < scores[peers[j]]
+		}
+		return peers[i] < peers[j]
+	})
+	set := make(map[int]bool)
+	for i, nodeID := range peers {
+		set[nodeID] = true
+		if quorum(set) {
+			return peers[:i+1]
+		}
+	}
+	return peers
+}
+
+// thriftyBroadcast sends a message to targets only, and to the other replicas as well
+// when done still does not hold after timeout
+func (h *NetworkingHub) thriftyBroadcast(targets []int, bytes []byte, timeout time.Duration, done func() bool) {
+	h.multicast(targets, bytes)
+	sent := make(map[int]bool, len(targets))
+	for _, nodeID := range targets {
+		sent[nodeID] = true
+	}
+	time.AfterFunc(timeout, func() {
+		if done() {
+			return
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for nodeID, p := range h.consensusConnections {
+			if !sent[nodeID] {
+				p.enqueue(bytes)
+			}
+		}
+	})
+}
+
+// clientSession is the session replies to a client go to, along with the timestamp
+// of the latest request that bound it
+type clientSession struct {
+	session   getty.Session
+	timestamp int
+}
+
+// registerClient binds a client to the session it sent a verified request on. Over mutual
+// TLS the session must present the certificate of the client, without TLS another live
+// session only takes over the binding with a newer request, a replayed one cannot,
+// it fails when the binding is kept
+func (h *NetworkingHub) registerClient(clientID int, timestamp int, session getty.Session) bool {
+	if tlsEnabled(tlsClient) {
+		client, ok := Clients[clientID]
+		key := sessionKey(session)
+		if !ok || key == nil || !client.pubkey.Equal(key) {
+			return false
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	existing, ok := h.clientConnections[clientID]
+	if ok && existing.session != session && !existing.session.IsClosed() &&
+		!tlsEnabled(tlsClient) && timestamp <= existing.timestamp {
+		return false
+	}
+	if ok && existing.session == session && timestamp < existing.timestamp {
+		timestamp = existing.timestamp
+	}
+	h.clientConnections[clientID] = &clientSession{session, timestamp}
+	return true
+}
+
+// unregisterClients drops the bindings of a closed session
+func (h *NetworkingHub) unregisterClients(session getty.Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for clientID, c := range h.clientConnections {
+		if c.session == session {
+			delete(h.clientConnections, clientID)
+		}
+	}
+}
+
+func (h *NetworkingHub) sendToClient(clientID int, bytes []byte) {
+	h.mu.Lock()
+	c, ok := h.clientConnections[clientID]
+	h.mu.Unlock()
+	if !ok {
+		Logger.Warnf("No connection to client %d, dropping reply", clientID)
+		return
 	}
+	c.session.Send(bytes)
 }
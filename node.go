@@ -1,31 +1,77 @@
 package main
 
 import (
-	"crypto/ed25519"
-	"encoding/json"
 	"fmt"
 	"sync"
 	"time"
+
+	"sr-bft/state"
 )
 
 // TODO : improve concurrency control
-const ViewID = 0
-
 type Node struct {
 	nodeID     int
 	info       *NodeInfo
-	privateKey *ed25519.PrivateKey
+	privateKey Signer
 	knownNodes []*NodeInfo
 	//clientNode *ClientNodeInfo
 	sequenceID int
 	View       int
-	msgQueue   chan []byte
+	msgQueue   chan []byte // messages that passed the verification stage
 	hub        *NetworkingHub
 	//stateTransferMsgQ chan []byte
 	//clientMsgQ        chan []byte adding and removing messages from the queue will be handled by the hub
-	msgLog      *MsgLog //Cons message log, add log for state transfer
-	requestPool map[string]*RequestMsg
+	msgLog      *MsgLog                       //Cons message log, add log for state transfer
+	requestPool map[string]*SignedRequestMsg  // client requests waiting to execute, by requestKey
+	batchPool   map[string][]SignedRequestMsg // batch digest -> its requests, in execution order
+	clientTable map[int]*clientRecord         // client ID -> its last executed request
 	mutex       sync.Mutex
+	// view change
+	viewChanging      bool
+	timeout           time.Duration // request timeout, from system config
+	viewChangeTimeout time.Duration // doubled after every view change that does not complete
+	timer             *time.Timer
+	timerID           int
+	timeoutQueue      chan int
+	deferredMsgs      map[deferredKey]*deferredMsg // messages of a view this node has not entered yet
+	// checkpoints
+	period              int
+	stableSeqID         int
+	stableProof         []SignedCheckpointMsg
+	lastExecuted        int
+	executedSeqs        map[int]string       // executed sequence number -> batch digest, up to the next stable checkpoint
+	executionQueue      map[int]string       // committed batches waiting for a lower sequence number
+	proposalQueue       [][]SignedRequestMsg // batches waiting for the high watermark to move
+	checkpointSnapshots map[int][]byte
+	stableSnapshot      []byte
+	// state transfer
+	stateTransferQueue chan *stateTransferPkg
+	transferVotes      map[int]map[string]map[int]bool // sequence number -> digest -> replicas reporting it
+	transferBatches    map[string][]SignedRequestMsg
+	lastFetch          time.Time
+	app                state.Application
+	snapshotFile       string
+	verifyStats        *VerificationStats
+	verifyQueues       []chan *inboundMsg // one per verification worker
+	// batching at the primary
+	batchConfig  batchConfig
+	batch        []SignedRequestMsg
+	batchBytes   int
+	batchTimer   *time.Timer
+	batchTimerID int
+	batchQueue   chan int
+	// chained HotStuff, when selected instead of PBFT
+	hotstuff *hotStuff
+	latency  *LatencyMonitor
+	// proposal rate of the primary
+	proposalCount  int // pre-prepares accepted in the current window
+	rateView       int
+	peakRate       float64
+	pendingAtCheck bool
+	rateQueue      chan struct{}
+	// weighted votes
+	quorum       *quorumSystem
+	weightEpochs []weightEpoch // assignments ordered through the log, by the sequence number they take effect at
 }
 
 type MsgLog struct {
@@ -33,17 +79,47 @@ type MsgLog struct {
 	prepareLog    map[string]map[int]bool
 	commitLog     map[string]map[int]bool
 	replyLog      map[string]bool
+	// signed messages kept to build prepared certificates
+	prePrepareMsgs map[string]*SignedPrePrepareMsg
+	prepareMsgs    map[string]map[int]*SignedPrepareMsg
+	viewChangeLog  map[int]map[int]*SignedViewChangeMsg
+	checkpointLog  map[int]map[int]*SignedCheckpointMsg
+	// signed commits and sent commit certificates at the collector
+	commitMsgs  map[string]map[int]*SignedCommitMsg
+	commitCerts map[string]bool
+	// when pre-prepares were accepted and the batches committed on the fast path
+	prePrepareAt map[string]time.Time
+	fastCommits  map[string]bool
+}
+
+type deferredMsg struct {
+	header  HeaderMsg
+	seq     int
+	payload []byte
+	sig     []byte
+}
+
+// a sender gets one slot per view, message type and sequence number
+type deferredKey struct {
+	header HeaderMsg
+	view   int
+	seq    int
+	sender int
 }
 
-func NewNode(nodeID int) *Node {
-	return &Node{
+// deferredViews is how many views ahead of the current one messages are kept
+const deferredViews = 4
+
+func NewNode(nodeID int, app state.Application) *Node {
+	timeout := time.Duration(SystemConfig["timeout"]) * time.Millisecond
+	node := &Node{
 		nodeID,
 		Replicas[nodeID],
 		PrivateKey,
 		Replicas,
 		//ClientNode,
 		0,
-		ViewID,
+		0,
 		make(chan []byte, 1000),
 		nil,
 		&MsgLog{
@@ -51,10 +127,66 @@ func NewNode(nodeID int) *Node {
 			make(map[string]map[int]bool),
 			make(map[string]map[int]bool),
 			make(map[string]bool),
+			make(map[string]*SignedPrePrepareMsg),
+			make(map[string]map[int]*SignedPrepareMsg),
+			make(map[int]map[int]*SignedViewChangeMsg),
+			make(map[int]map[int]*SignedCheckpointMsg),
+			make(map[string]map[int]*SignedCommitMsg),
+			make(map[string]bool),
+			make(map[string]time.Time),
+			make(map[string]bool),
 		},
-		make(map[string]*RequestMsg),
+		make(map[string]*SignedRequestMsg),
+		make(map[string][]SignedRequestMsg),
+		make(map[int]*clientRecord),
 		sync.Mutex{},
+		false,
+		timeout,
+		timeout,
+		nil,
+		0,
+		make(chan int, 16),
+		make(map[deferredKey]*deferredMsg),
+		SystemConfig["period"],
+		-1,
+		nil,
+		-1,
+		make(map[int]string),
+		make(map[int]string),
+		nil,
+		make(map[int][]byte),
+		[]byte{},
+		make(chan *stateTransferPkg, 100),
+		make(map[int]map[string]map[int]bool),
+		make(map[string][]SignedRequestMsg),
+		time.Time{},
+		app,
+		fmt.Sprintf("./snapshots/%d.snap", nodeID),
+		NewVerificationStats(),
+		newVerifyQueues(),
+		newBatchConfig(),
+		nil,
+		0,
+		nil,
+		0,
+		make(chan int, 16),
+		nil,
+		newLatencyMonitor(nodeID),
+		0,
+		-1,
+		0,
+		false,
+		make(chan struct{}, 1),
+		nil,
+		nil,
+	}
+	quorum, err := newQuorumSystem(Replicas, node.countTolerateFaultNode())
+	if err != nil {
+		Logger.Fatalf("Invalid replica weights: %v", err)
 	}
+	node.quorum = quorum
+	node.hotstuff = newHotStuff(node)
+	return node
 }
 
 func (node *Node) getSequenceID() int {
@@ -64,61 +196,109 @@ func (node *Node) getSequenceID() int {
 }
 
 func (node *Node) Start() {
+	node.loadCheckpoint()
+	node.startVerifiers()
 	go node.handleMsg()
+	go node.monitorStragglers()
+	go node.monitorPrimary()
 }
 
 // message handler function, create a handler for each Queue
 func (node *Node) handleMsg() {
 	for {
-		msg := <-node.msgQueue
-		header, payload, sign := SplitMsg(msg)
-		switch header {
-		case hRequest:
-			node.handleRequest(payload, sign)
-		case hPrePrepare:
-			node.handlePrePrepare(payload, sign)
-		case hPrepare:
-			node.handlePrepare(payload, sign)
-		case hCommit:
-			node.handleCommit(payload, sign)
+		select {
+		case msg := <-node.msgQueue:
+			header, payload, sign := SplitMsg(msg)
+			node.dispatch(header, payload, sign)
+		case timerID := <-node.timeoutQueue:
+			node.handleTimeout(timerID)
+		case pkg := <-node.stateTransferQueue:
+			node.handleStateTransfer(pkg)
+		case timerID := <-node.batchQueue:
+			node.handleBatchTimeout(timerID)
+		case <-node.rateQueue:
+			node.checkProposalRate()
 		}
 	}
 }
 
+func (node *Node) dispatch(header HeaderMsg, payload []byte, sign []byte) {
+	if hotstuffMode() {
+		node.hotstuff.dispatch(header, payload, sign)
+		return
+	}
+	switch header {
+	case hRequest:
+		node.handleRequest(payload, sign)
+	case hPrePrepare:
+		node.handlePrePrepare(payload, sign)
+	case hPrepare:
+		node.handlePrepare(payload, sign)
+	case hCommit:
+		node.handleCommit(payload, sign)
+	case hViewChange:
+		node.handleViewChange(payload, sign)
+	case hNewView:
+		node.handleNewView(payload, sign)
+	case hCheckpoint:
+		node.handleCheckpoint(payload, sign)
+	case hPrepareCert:
+		node.handlePrepareCert(payload, sign)
+	case hCommitCert:
+		node.handleCommitCert(payload, sign)
+	}
+}
+
 func (node *Node) handleRequest(payload []byte, sig []byte) {
 	var request RequestMsg
-	var prePrepareMsg PrePrepareMsg
-	err := json.Unmarshal(payload, &request)
+	err := decodeMsg(payload, &request)
 	if err != nil {
 		Logger.Error("Error in Request Handling:%v", err)
 		return
 	}
 	logHandleMsg(hRequest, request, request.ClientID)
-	// verify request's digest
-	vdig := verifyDigest(request.CRequest.Message, request.CRequest.Digest)
-	if !vdig {
-		Logger.Error("Verify digest failed in Request Handling")
+	// digest and signature were checked by the verification stage
+
+	signed := node.admitRequest(request, sig)
+	if signed == nil {
 		return
 	}
+	node.mutex.Lock()
+	isPrimary := node.findPrimaryNode() == node.nodeID && !node.viewChanging
+	node.mutex.Unlock()
 
-	//TODO verify request's signature
-	_ = sig
-	if err != nil {
-		Logger.Error("Verify request signature failed in Request Handling:%v", err)
+	if !isPrimary {
+		// backups wait for the primary to order the request
+		node.startTimer()
 		return
 	}
+	node.addToBatch(*signed)
+}
 
+// propose assigns the next sequence number to a batch and broadcasts its pre-prepare
+func (node *Node) propose(batch []SignedRequestMsg) {
 	node.mutex.Lock()
-	node.requestPool[request.CRequest.Digest] = &request
-	seqID := node.getSequenceID()
-	node.mutex.Unlock()
-
-	prePrepareMsg = PrePrepareMsg{
-		request,
-		request.CRequest.Digest,
-		ViewID,
-		seqID,
+	if node.sequenceID > node.highWatermark() {
+		// the log is full until the next checkpoint becomes stable
+		node.proposalQueue = append(node.proposalQueue, batch)
+		node.mutex.Unlock()
+		return
 	}
+	weights, ok := node.weightsFor(node.sequenceID)
+	if !ok {
+		// the weights of the sequence number depend on batches not executed yet
+		node.proposalQueue = append(node.proposalQueue, batch)
+		node.mutex.Unlock()
+		return
+	}
+	prePrepareMsg := PrePrepareMsg{
+		batch,
+		batchDigest(batch),
+		node.View,
+		node.getSequenceID(),
+		weights,
+	}
+	node.mutex.Unlock()
 	//sign prePrepareMsg
 	msgSig, err := node.signMessage(prePrepareMsg)
 	if err != nil {
@@ -128,12 +308,9 @@ func (node *Node) handleRequest(payload []byte, sig []byte) {
 
 	msg := ComposeMsg(hPrePrepare, prePrepareMsg, msgSig)
 	node.mutex.Lock()
-
 	// put preprepare msg into log
-	if node.msgLog.preprepareLog[prePrepareMsg.Digest] == nil {
-		node.msgLog.preprepareLog[prePrepareMsg.Digest] = make(map[int]bool)
-	}
-	node.msgLog.preprepareLog[prePrepareMsg.Digest][node.nodeID] = true
+	node.storeBatch(prePrepareMsg.Digest, prePrepareMsg.Requests)
+	node.logPrePrepare(prePrepareMsg, msgSig)
 	node.mutex.Unlock()
 	logBroadcastMsg(hPrePrepare, prePrepareMsg)
 	node.broadcast(msg)
@@ -142,52 +319,49 @@ func (node *Node) handleRequest(payload []byte, sig []byte) {
 // should be moved to consensus
 func (node *Node) handlePrePrepare(payload []byte, sig []byte) {
 	var prePrepareMsg PrePrepareMsg
-	err := json.Unmarshal(payload, &prePrepareMsg)
+	err := decodeMsg(payload, &prePrepareMsg)
 	if err != nil {
 		Logger.Error("Error happened in handle PrePrepare:%v", err)
 		return
 	}
+	if !node.checkView(hPrePrepare, prePrepareMsg.ViewID, prePrepareMsg.SequenceID, node.primaryOf(prePrepareMsg.ViewID), payload, sig) {
+		return
+	}
 
 	pnodeId := node.findPrimaryNode()
 	logHandleMsg(hPrePrepare, prePrepareMsg, pnodeId)
-	msgPubkey := node.findNodePubkey(pnodeId)
-	if msgPubkey == nil {
-		Logger.Error("Find node pubkey failed in handle PrePrepare\n")
-	}
-	// verify msg's signature
-	copy_pk := *msgPubkey
-
-	v := verifySignatrue(prePrepareMsg, sig, &copy_pk)
-
-	if !v {
-		Logger.Error("Verify signature failed in handle PrePrepare\n")
-		panic("PAAAANICCCCCC")
-
-	}
-
-	// verify prePrepare's digest is equal to request's digest
-	if prePrepareMsg.Digest != prePrepareMsg.Request.CRequest.Digest {
-		Logger.Error("Verify digest failed in handle PrePrepare\n")
+	// the signature and the batch were checked by the verification stage
+	if !node.inWatermarks(prePrepareMsg.SequenceID) {
+		Logger.Error("PrePrepare sequence %d out of watermarks\n", prePrepareMsg.SequenceID)
 		return
 	}
 	node.mutex.Lock()
-	node.requestPool[prePrepareMsg.Request.CRequest.Digest] = &prePrepareMsg.Request
+	weights, known := node.weightsFor(prePrepareMsg.SequenceID)
+	conflict := node.conflictingPrePrepare(&prePrepareMsg)
 	node.mutex.Unlock()
-	err = node.verifyRequestDigest(prePrepareMsg.Digest)
-	if err != nil {
-		Logger.Error("Verify request digest failed in handle PrePrepare:%v\n", err)
+	if !known || !node.quorum.sameWeights(prePrepareMsg.Weights, weights) {
+		Logger.Errorf("PrePrepare sequence %d does not carry the weights %v", prePrepareMsg.SequenceID, weights)
 		return
 	}
+	if conflict {
+		Logger.Errorf("PrePrepare sequence %d was already assigned in view %d", prePrepareMsg.SequenceID, prePrepareMsg.ViewID)
+		return
+	}
+	node.acceptPrePrepare(prePrepareMsg, sig)
+	node.startTimer()
+}
+
+// acceptPrePrepare logs a verified pre-prepare and answers it with a prepare
+func (node *Node) acceptPrePrepare(prePrepareMsg PrePrepareMsg, sig []byte) {
 	// put preprepare's msg into log
 	node.mutex.Lock()
-	if node.msgLog.preprepareLog[prePrepareMsg.Digest] == nil {
-		node.msgLog.preprepareLog[prePrepareMsg.Digest] = make(map[int]bool)
-	}
-	node.msgLog.preprepareLog[prePrepareMsg.Digest][pnodeId] = true
+	node.storeBatch(prePrepareMsg.Digest, prePrepareMsg.Requests)
+	node.logPrePrepare(prePrepareMsg, sig)
+	node.proposalCount++
 	node.mutex.Unlock()
 	prepareMsg := PrepareMsg{
 		prePrepareMsg.Digest,
-		ViewID,
+		prePrepareMsg.ViewID,
 		prePrepareMsg.SequenceID,
 		node.nodeID,
 	}
@@ -201,67 +375,80 @@ func (node *Node) handlePrePrepare(payload []byte, sig []byte) {
 	sendMsg := ComposeMsg(hPrepare, prepareMsg, msgSig)
 	node.mutex.Lock()
 	// put prepare msg into log
-	if node.msgLog.prepareLog[prepareMsg.Digest] == nil {
-		node.msgLog.prepareLog[prepareMsg.Digest] = make(map[int]bool)
-	}
-	node.msgLog.prepareLog[prepareMsg.Digest][node.nodeID] = true
+	node.logPrepare(prepareMsg, msgSig)
 	node.mutex.Unlock()
+	if collectorMode() {
+		node.send(node.collectorOf(prepareMsg.ViewID), sendMsg)
+		return
+	}
 	logBroadcastMsg(hPrepare, prepareMsg)
-	node.broadcast(sendMsg)
+	node.broadcastVote(hPrepare, prepareMsg.Digest, prePrepareMsg.Weights, sendMsg)
 }
 
 func (node *Node) handlePrepare(payload []byte, sig []byte) {
 	var prepareMsg PrepareMsg
-	err := json.Unmarshal(payload, &prepareMsg)
+	err := decodeMsg(payload, &prepareMsg)
 	if err != nil {
 		Logger.Error("Error happened in handle Prepare:%v", err)
 		return
 	}
+	if !node.checkView(hPrepare, prepareMsg.ViewID, prepareMsg.SequenceID, prepareMsg.NodeID, payload, sig) {
+		return
+	}
 	logHandleMsg(hPrepare, prepareMsg, prepareMsg.NodeID)
-	pubkey := node.findNodePubkey(prepareMsg.NodeID)
-
-	v := verifySignatrue(prepareMsg, sig, pubkey)
-	if !v {
-		Logger.Error("Verify signature failed in handle Prepare\n")
+	if !node.inWatermarks(prepareMsg.SequenceID) {
 		return
 	}
-
-	// verify request's digest
-	err = node.verifyRequestDigest(prepareMsg.Digest)
+	// verify batch's digest
+	err = node.verifyBatchDigest(prepareMsg.Digest)
 	if err != nil {
-		Logger.Error("Verify request digest failed in handle Prepare:%v\n", err)
+		Logger.Error("Verify batch digest failed in handle Prepare:%v\n", err)
 		return
 	}
 	// verify prepareMsg's digest is equal to preprepareMsg's digest
 	pnodeId := node.findPrimaryNode()
+	node.mutex.Lock()
 	exist := node.msgLog.preprepareLog[prepareMsg.Digest][pnodeId]
+	prePrepare := node.msgLog.prePrepareMsgs[prepareMsg.Digest]
+	node.mutex.Unlock()
 	if !exist {
 		Logger.Error("this digest's preprepare msg by %d not existed\n", pnodeId)
 		return
 	}
+	if prePrepare.PrePrepare.SequenceID != prepareMsg.SequenceID {
+		Logger.Error("Prepare sequence %d does not match preprepare sequence %d\n", prepareMsg.SequenceID, prePrepare.PrePrepare.SequenceID)
+		return
+	}
 	// put prepareMsg into log
 	node.mutex.Lock()
-	if node.msgLog.prepareLog[prepareMsg.Digest] == nil {
-		node.msgLog.prepareLog[prepareMsg.Digest] = make(map[int]bool)
-	}
-	node.msgLog.prepareLog[prepareMsg.Digest][prepareMsg.NodeID] = true
+	node.logPrepare(prepareMsg, sig)
 	node.mutex.Unlock()
-
-	// if receive prepare msg >= 2f +1, then broadcast commit msg
-	limit := node.countNeedReceiveMsgAmount()
-	sum, err := node.findVerifiedPrepareMsgCount(prepareMsg.Digest)
-	if err != nil {
-		Logger.Error("Find Verified PrepareMsg Count Failed in handle Prepare:%v", err)
+	// the replica's own prepare and the primary's pre-prepare are part of the quorum
+	weights := prePrepare.PrePrepare.Weights
+	node.latency.observe(hPrepare, prepareMsg.Digest, prepareMsg.NodeID, func(arrivals map[int]bool) bool {
+		return node.quorum.isQuorum(weights, voters(arrivals, node.nodeID, pnodeId))
+	})
+	if collectorMode() {
+		if node.collectorOf(prepareMsg.ViewID) == node.nodeID {
+			node.collectPrepares(prepareMsg, weights)
+		}
 		return
 	}
-	if sum >= limit {
-		// if already send commit msg, then do nothing
-		node.mutex.Lock()
-		exist := node.msgLog.commitLog[prepareMsg.Digest][node.nodeID]
-		node.mutex.Unlock()
-		if !exist {
-			return
-		}
+
+	// if the prepares hold a quorum, then broadcast commit msg
+	// (the primary's pre-prepare stands in for its prepare)
+	node.mutex.Lock()
+	prepares := voters(node.msgLog.prepareLog[prepareMsg.Digest], pnodeId)
+	prepared := node.quorum.isQuorum(weights, prepares)
+	fast := node.onFastPath(prepareMsg.Digest, prepares)
+	// if already send commit msg, then do not send it again
+	sent := node.msgLog.commitLog[prepareMsg.Digest][node.nodeID]
+	node.mutex.Unlock()
+	if fast {
+		Logger.Debugf("Sequence %d committed on the fast path", prepareMsg.SequenceID)
+		node.commit(prepareMsg.SequenceID, prepareMsg.Digest)
+	}
+	if prepared && !sent {
 		//send commit msg
 
 		commitMsg := CommitMsg{
@@ -270,9 +457,10 @@ func (node *Node) handlePrepare(payload []byte, sig []byte) {
 			prepareMsg.SequenceID,
 			node.nodeID,
 		}
-		sig, err := node.signMessage(commitMsg)
+		sig, err := node.authenticate(hCommit, commitMsg)
 		if err != nil {
-			fmt.Printf("sign message happened error:%v\n", err)
+			Logger.Errorf("Sign commit msg failed:%v", err)
+			return
 		}
 		sendMsg := ComposeMsg(hCommit, commitMsg, sig)
 		// put commit msg to log
@@ -283,112 +471,126 @@ func (node *Node) handlePrepare(payload []byte, sig []byte) {
 		node.msgLog.commitLog[commitMsg.Digest][node.nodeID] = true
 		node.mutex.Unlock()
 		logBroadcastMsg(hCommit, commitMsg)
-		node.broadcast(sendMsg)
+		node.broadcastVote(hCommit, commitMsg.Digest, weights, sendMsg)
 	}
 }
 
 func (node *Node) handleCommit(payload []byte, sig []byte) {
 	var commitMsg CommitMsg
-	err := json.Unmarshal(payload, &commitMsg)
+	err := decodeMsg(payload, &commitMsg)
 	if err != nil {
 		Logger.Error("Error happened in handle Commit:%v", err)
+		return
+	}
+	if !node.checkView(hCommit, commitMsg.ViewID, commitMsg.SequenceID, commitMsg.NodeID, payload, sig) {
+		return
 	}
 	logHandleMsg(hCommit, commitMsg, commitMsg.NodeID)
-	//verify commitMsg's signature
-	msgPubKey := node.findNodePubkey(commitMsg.NodeID)
-	v := verifySignatrue(commitMsg, sig, msgPubKey)
-	if !v {
-		Logger.Error("Verify signature failed in handle Commit\n")
+	if !node.inWatermarks(commitMsg.SequenceID) {
 		return
 	}
-
-	err = node.verifyRequestDigest(commitMsg.Digest)
+	err = node.verifyBatchDigest(commitMsg.Digest)
 	if err != nil {
-		Logger.Error("Verify request digest failed in handle Commit:%v\n", err)
+		Logger.Error("Verify batch digest failed in handle Commit:%v\n", err)
 		return
 	}
-	// put commitMsg into log
 	node.mutex.Lock()
-	if node.msgLog.commitLog[commitMsg.Digest] == nil {
-		node.msgLog.commitLog[commitMsg.Digest] = make(map[int]bool)
-	}
-	node.msgLog.commitLog[commitMsg.Digest][commitMsg.NodeID] = true
+	prePrepare := node.msgLog.prePrepareMsgs[commitMsg.Digest]
 	node.mutex.Unlock()
-	// if receive commit msg >= 2f +1, then send reply msg to client
-	limit := node.countNeedReceiveMsgAmount()
-
-	sum, err := node.findVerifiedCommitMsgCount(commitMsg.Digest)
-	if err != nil {
-		Logger.Error("Find Verified CommitMsg Count Failed in handle Commit:%v", err)
+	// execute at the sequence number the primary assigned, not the one in the commit
+	if prePrepare == nil || prePrepare.PrePrepare.SequenceID != commitMsg.SequenceID {
+		Logger.Error("Commit sequence %d does not match the preprepare\n", commitMsg.SequenceID)
 		return
 	}
-	if sum >= limit {
-		// if already send reply msg, then do nothing
-		node.mutex.Lock()
-		exist := node.msgLog.replyLog[commitMsg.Digest]
-		node.mutex.Unlock()
-		if exist {
+	weights := prePrepare.PrePrepare.Weights
+	node.latency.observe(hCommit, commitMsg.Digest, commitMsg.NodeID, func(arrivals map[int]bool) bool {
+		return node.quorum.isQuorum(weights, voters(arrivals, node.nodeID))
+	})
+	if collectorMode() {
+		if node.collectorOf(commitMsg.ViewID) != node.nodeID {
 			return
 		}
-		// send reply msg
-		node.mutex.Lock()
-		requestMsg := node.requestPool[commitMsg.Digest]
-		node.mutex.Unlock()
-		//fmt.Printf("operstion:%s  message:%s executed... \n", requestMsg.Operation, requestMsg.CRequest.Message)
-		done := fmt.Sprintf("operstion:%s  message:%s done ", requestMsg.Operation, requestMsg.CRequest.Message)
-		replyMsg := ReplyMsg{
-			node.View,
-			int(time.Now().Unix()),
-			requestMsg.ClientID,
-			node.nodeID,
-			done,
-		}
-		logBroadcastMsg(hReply, replyMsg)
-		// normally we can extract client ID from requestMsg
-		//sendMsg := ComposeMsg(hReply, replyMsg, []byte{})
-		//node.sendToClient(sendMsg)
-		Logger.Info("Reply to client:%v\n", replyMsg)
 		node.mutex.Lock()
-		node.msgLog.replyLog[commitMsg.Digest] = true
+		node.logCommit(commitMsg, sig)
 		node.mutex.Unlock()
+		node.collectCommits(commitMsg, weights)
+		return
+	}
+	// put commitMsg into log
+	node.mutex.Lock()
+	if node.msgLog.commitLog[commitMsg.Digest] == nil {
+		node.msgLog.commitLog[commitMsg.Digest] = make(map[int]bool)
+	}
+	node.msgLog.commitLog[commitMsg.Digest][commitMsg.NodeID] = true
+	// if the commits hold a quorum, then send reply msg to client
+	committed := node.quorum.isQuorum(weights, node.msgLog.commitLog[commitMsg.Digest])
+	// if already executed, then do nothing
+	exist := node.msgLog.replyLog[commitMsg.Digest]
+	node.mutex.Unlock()
+	if committed && !exist {
+		node.commit(commitMsg.SequenceID, commitMsg.Digest)
 	}
 }
 
-func (node *Node) verifyRequestDigest(digest string) error {
+// checkView tells whether a normal-case message belongs to the current view, messages
+// for one of the next deferredViews views the node has not entered yet are kept until
+// it does, as long as their sequence number lies inside the watermarks
+func (node *Node) checkView(header HeaderMsg, viewID int, seq int, sender int, payload []byte, sig []byte) bool {
 	node.mutex.Lock()
-	_, ok := node.requestPool[digest]
-	if !ok {
-		node.mutex.Unlock()
-		return fmt.Errorf("verify request digest failed")
+	defer node.mutex.Unlock()
+	if viewID == node.View && !node.viewChanging {
+		return true
+	}
+	if viewID < node.View || viewID > node.View+deferredViews ||
+		seq <= node.stableSeqID || seq > node.highWatermark() {
+		return false
+	}
+	node.deferredMsgs[deferredKey{header, viewID, seq, sender}] = &deferredMsg{header, seq, payload, sig}
+	return false
+}
 
+// must be called with node.mutex held
+func (node *Node) logPrePrepare(prePrepareMsg PrePrepareMsg, sig []byte) {
+	if node.msgLog.preprepareLog[prePrepareMsg.Digest] == nil {
+		node.msgLog.preprepareLog[prePrepareMsg.Digest] = make(map[int]bool)
 	}
-	node.mutex.Unlock()
-	return nil
+	node.msgLog.preprepareLog[prePrepareMsg.Digest][node.findPrimaryNode()] = true
+	node.msgLog.prePrepareMsgs[prePrepareMsg.Digest] = &SignedPrePrepareMsg{prePrepareMsg, sig}
+	node.msgLog.prePrepareAt[prePrepareMsg.Digest] = time.Now()
 }
 
-func (node *Node) findVerifiedPrepareMsgCount(digest string) (int, error) {
-	sum := 0
-	node.mutex.Lock()
-	for _, exist := range node.msgLog.prepareLog[digest] {
-		if exist {
-			sum++
+// conflictingPrePrepare tells whether the replica accepted another batch at the same
+// view and sequence number, must be called with node.mutex held
+func (node *Node) conflictingPrePrepare(prePrepareMsg *PrePrepareMsg) bool {
+	for digest, logged := range node.msgLog.prePrepareMsgs {
+		if digest != prePrepareMsg.Digest && logged.PrePrepare.ViewID == prePrepareMsg.ViewID &&
+			logged.PrePrepare.SequenceID == prePrepareMsg.SequenceID {
+			return true
 		}
 	}
-	node.mutex.Unlock()
-	return sum, nil
+	return false
+}
+
+// must be called with node.mutex held
+func (node *Node) logPrepare(prepareMsg PrepareMsg, sig []byte) {
+	if node.msgLog.prepareLog[prepareMsg.Digest] == nil {
+		node.msgLog.prepareLog[prepareMsg.Digest] = make(map[int]bool)
+		node.msgLog.prepareMsgs[prepareMsg.Digest] = make(map[int]*SignedPrepareMsg)
+	}
+	node.msgLog.prepareLog[prepareMsg.Digest][prepareMsg.NodeID] = true
+	node.msgLog.prepareMsgs[prepareMsg.Digest][prepareMsg.NodeID] = &SignedPrepareMsg{prepareMsg, sig}
 }
 
-func (node *Node) findVerifiedCommitMsgCount(digest string) (int, error) {
-	sum := 0
+func (node *Node) verifyBatchDigest(digest string) error {
 	node.mutex.Lock()
-	for _, exist := range node.msgLog.commitLog[digest] {
+	_, ok := node.batchPool[digest]
+	if !ok {
+		node.mutex.Unlock()
+		return fmt.Errorf("verify batch digest failed")
 
-		if exist {
-			sum++
-		}
 	}
 	node.mutex.Unlock()
-	return sum, nil
+	return nil
 }
 
 // should be moved to networking
@@ -396,12 +598,31 @@ func (node *Node) broadcast(data []byte) {
 	node.hub.broadcast(data)
 }
 
-func (node *Node) sendToClient(data []byte) {
-	node.hub.sendToClient(data)
+func (node *Node) send(nodeID int, data []byte) {
+	node.hub.send(nodeID, data)
+}
+
+func (node *Node) multicast(nodeIDs []int, data []byte) {
+	node.hub.multicast(nodeIDs, data)
+}
+
+func (node *Node) sendToClient(clientID int, data []byte) {
+	node.hub.sendToClient(clientID, data)
+}
+
+func (node *Node) verifyRequestSignature(request *RequestMsg, sig []byte) error {
+	client, ok := Clients[request.ClientID]
+	if !ok {
+		return fmt.Errorf("unknown client %d", request.ClientID)
+	}
+	if !verifySignatrue(*request, sig, client.pubkey) {
+		return fmt.Errorf("invalid signature from client %d", request.ClientID)
+	}
+	return nil
 }
 
 // do we need fast access to the public key of a node?
-func (node *Node) findNodePubkey(nodeId int) *ed25519.PublicKey {
+func (node *Node) findNodePubkey(nodeId int) Verifier {
 	for _, knownNode := range node.knownNodes {
 		if knownNode.nodeID == nodeId {
 			return knownNode.pubKey
@@ -412,8 +633,7 @@ func (node *Node) findNodePubkey(nodeId int) *ed25519.PublicKey {
 
 // Useless function ??
 func (node *Node) signMessage(msg interface{}) ([]byte, error) {
-	sk_copy := *node.privateKey
-	sig, err := signMessage(msg, &sk_copy)
+	sig, err := signMessage(msg, node.privateKey)
 	if err != nil {
 		Logger.Error("Sign message failed:%v", err)
 		return nil, err
@@ -424,16 +644,30 @@ func (node *Node) signMessage(msg interface{}) ([]byte, error) {
 
 // find leader
 func (node *Node) findPrimaryNode() int {
-	return ViewID % len(node.knownNodes)
+	return node.primaryOf(node.View)
+}
+
+func (node *Node) primaryOf(view int) int {
+	return view % len(node.knownNodes)
 }
 
 // this is part of system config
 func (node *Node) countTolerateFaultNode() int {
-	return (len(node.knownNodes) - 1) / 3
+	return faultTolerance(len(node.knownNodes))
 }
 
-// this is part of system config
+// quorums of replicas counted without their weights, like the ones of view changes and
+// checkpoints: n-f, which is 2f+1 without extra replicas
 func (node *Node) countNeedReceiveMsgAmount() int {
-	f := node.countTolerateFaultNode()
-	return 2*f + 1
+	return len(node.knownNodes) - node.countTolerateFaultNode()
+}
+
+// faultTolerance is the f of system config, n replicas tolerate at most (n-1)/3 faults
+// and the extra replicas of weighted quorums do not raise f
+func faultTolerance(n int) int {
+	f := (n - 1) / 3
+	if configured := SystemConfig["f"]; configured > 0 && configured < f {
+		return configured
+	}
+	return f
 }
@@ -2,21 +2,18 @@ package main
 
 // move thsi to networking
 
-import (
-	"crypto/ed25519"
-)
-
 type NodeInfo struct {
 	nodeID            int
 	ip                string
 	clientPort        int
 	consensusPort     int
 	stateTransferPort int
-	pubKey            *ed25519.PublicKey
+	pubKey            Verifier
+	weight            int // voting weight, from the optional last column of hosts.config
 }
 
 type ClientNodeInfo struct {
 	nodeID int
 	url    string
-	pubkey *ed25519.PublicKey
+	pubkey Verifier
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	getty "github.com/apache/dubbo-getty"
+)
+
+// peer is an authenticated consensus session with its own outbound queue,
+// so a slow replica only delays the messages sent to it
+type peer struct {
+	nodeID  int
+	session getty.Session
+	macKey  []byte // session key agreed in the handshake
+	queue   chan []byte
+	done    chan struct{}
+}
+
+func newPeer(nodeID int, session getty.Session, macKey []byte, size int) *peer {
+	if size <= 0 {
+		size = 1000
+	}
+	p := &peer{
+		nodeID,
+		session,
+		macKey,
+		make(chan []byte, size),
+		make(chan struct{}),
+	}
+	go p.sendLoop()
+	return p
+}
+
+func (p *peer) sendLoop() {
+	for {
+		select {
+		case msg := <-p.queue:
+			_, err := p.session.Send(msg)
+			if err != nil {
+				Logger.Warnf("Sending to replica %d failed:%v", p.nodeID, err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// enqueue never blocks, a message is dropped when the peer's queue is full
+func (p *peer) enqueue(msg []byte) {
+	select {
+	case p.queue <- msg:
+	default:
+		Logger.Warnf("Send queue to replica %d is full, dropping message", p.nodeID)
+	}
+}
+
+func (p *peer) stop() {
+	close(p.done)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+
+	getty "github.com/apache/dubbo-getty"
+)
+
+// The verification stage runs in front of the ordering logic in handleMsg:
+// workers decode incoming messages and check their signatures in parallel,
+// only the messages that verify reach node.msgQueue. A sender is always served
+// by the same worker, so its messages keep their order.
+// The standard library has no ed25519 batch verification, every worker
+// checks its messages one by one.
+
+// clientSender is the sender of the messages received on client sessions
+const clientSender = -1
+
+// inboundMsg is a received message waiting for verification
+type inboundMsg struct {
+	sender  int           // the authenticated replica it arrived from, or clientSender
+	session getty.Session // the client session a request arrived on, nil for replica messages
+	msg     []byte
+}
+
+// source names the sender of a client message in the rejection counters
+func (in *inboundMsg) source() string {
+	if in.session == nil {
+		return "local"
+	}
+	return in.session.RemoteAddr()
+}
+
+func newVerifyQueues() []chan *inboundMsg {
+	workers := SystemConfig["verifyWorkers"]
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	queues := make([]chan *inboundMsg, workers)
+	for i := range queues {
+		queues[i] = make(chan *inboundMsg, 1000)
+	}
+	return queues
+}
+
+func (node *Node) startVerifiers() {
+	for _, queue := range node.verifyQueues {
+		go node.verifyLoop(queue)
+	}
+}
+
+// submit hands a message received from a replica to the verification stage
+func (node *Node) submit(nodeID int, msg []byte) {
+	node.enqueueInbound(nodeID, &inboundMsg{nodeID, nil, msg})
+}
+
+// submitClient hands a message received on a client session to the verification
+// stage, the lane is picked by session as the client it claims to be is not verified yet
+func (node *Node) submitClient(session getty.Session, msg []byte) {
+	lane := len(node.knownNodes)
+	if session != nil {
+		lane += int(session.ID())
+	}
+	node.enqueueInbound(lane, &inboundMsg{clientSender, session, msg})
+}
+
+func (node *Node) enqueueInbound(lane int, in *inboundMsg) {
+	if lane < 0 {
+		lane = -lane
+	}
+	node.verifyQueues[lane%len(node.verifyQueues)] <- in
+}
+
+func (node *Node) verifyLoop(queue chan *inboundMsg) {
+	for in := range queue {
+		header, payload, sig := SplitMsg(in.msg)
+		if node.verifyInbound(in, header, payload, sig) {
+			node.msgQueue <- in.msg
+		}
+	}
+}
+
+// verifyInbound checks everything about a message that does not depend on the
+// state of the replica, failures are counted against the sender
+func (node *Node) verifyInbound(in *inboundMsg, header HeaderMsg, payload []byte, sig []byte) bool {
+	if in.sender == clientSender && header != hRequest {
+		Logger.Warnf("Dropping %s from client %s", header, in.source())
+		return false
+	}
+	if in.sender != clientSender && header == hRequest {
+		node.rejectReplicaMsg(header, in.sender, "replicas do not send requests")
+		return false
+	}
+	switch header {
+	case hRequest:
+		var request RequestMsg
+		if err := decodeMsg(payload, &request); err != nil {
+			return decodeFailed(header, err)
+		}
+		if !verifyDigest(request.CRequest.Message, request.CRequest.Digest) {
+			node.rejectClientRequest(in.source(), request.ClientID, "invalid digest")
+			return false
+		}
+		// verify request's signature against the registered key of its client
+		err := node.verifyRequestSignature(&request, sig)
+		if err != nil {
+			node.rejectClientRequest(in.source(), request.ClientID, err.Error())
+			return false
+		}
+		// only a verified request binds its session to the client
+		if in.session != nil && !node.hub.registerClient(request.ClientID, request.Timestamp, in.session) {
+			Logger.Warnf("Session %s does not take over the replies of client %d", in.session.RemoteAddr(), request.ClientID)
+		}
+	case hPrePrepare:
+		var prePrepareMsg PrePrepareMsg
+		if err := decodeMsg(payload, &prePrepareMsg); err != nil {
+			return decodeFailed(header, err)
+		}
+		primary := node.primaryOf(prePrepareMsg.ViewID)
+		if !node.signedBySender(in, header, primary) || !node.verifyReplicaMsg(hPrePrepare, primary, prePrepareMsg, sig) {
+			return false
+		}
+		// verify every request of the batch and the batch's digest
+		err := node.verifyBatch(prePrepareMsg.Digest, prePrepareMsg.Requests)
+		if err != nil {
+			node.rejectReplicaMsg(hPrePrepare, primary, err.Error())
+			return false
+		}
+	case hPrepare:
+		var prepareMsg PrepareMsg
+		if err := decodeMsg(payload, &prepareMsg); err != nil {
+			return decodeFailed(header, err)
+		}
+		return node.signedBySender(in, header, prepareMsg.NodeID) && node.verifyReplicaMsg(hPrepare, prepareMsg.NodeID, prepareMsg, sig)
+	case hCommit:
+		var commitMsg CommitMsg
+		if err := decodeMsg(payload, &commitMsg); err != nil {
+			return decodeFailed(header, err)
+		}
+		return node.signedBySender(in, header, commitMsg.NodeID) && node.verifyReplicaMsg(hCommit, commitMsg.NodeID, commitMsg, sig)
+	case hPrepareCert:
+		var certMsg PrepareCertMsg
+		if err := decodeMsg(payload, &certMsg); err != nil {
+			return decodeFailed(header, err)
+		}
+		return node.signedBySender(in, header, certMsg.NodeID) && node.verifyPrepareCert(&certMsg, sig)
+	case hCommitCert:
+		var certMsg CommitCertMsg
+		if err := decodeMsg(payload, &certMsg); err != nil {
+			return decodeFailed(header, err)
+		}
+		return node.signedBySender(in, header, certMsg.NodeID) && node.verifyCommitCert(&certMsg, sig)
+	case hHsProposal:
+		var proposal ProposalMsg
+		if err := decodeMsg(payload, &proposal); err != nil {
+			return decodeFailed(header, err)
+		}
+		return node.signedBySender(in, header, proposal.NodeID) && node.verifyProposal(&proposal, sig)
+	case hHsVote:
+		var voteMsg VoteMsg
+		if err := decodeMsg(payload, &voteMsg); err != nil {
+			return decodeFailed(header, err)
+		}
+		return node.signedBySender(in, header, voteMsg.NodeID) && node.verifyReplicaMsg(hHsVote, voteMsg.NodeID, voteMsg, sig)
+	case hHsNewView:
+		var newViewMsg HsNewViewMsg
+		if err := decodeMsg(payload, &newViewMsg); err != nil {
+			return decodeFailed(header, err)
+		}
+		if !node.signedBySender(in, header, newViewMsg.NodeID) || !node.verifyReplicaMsg(hHsNewView, newViewMsg.NodeID, newViewMsg, sig) {
+			return false
+		}
+		if !node.verifyQC(&newViewMsg.HighQC) {
+			node.rejectReplicaMsg(hHsNewView, newViewMsg.NodeID, "invalid certificate")
+			return false
+		}
+	case hCheckpoint:
+		var checkpointMsg CheckpointMsg
+		if err := json.Unmarshal(payload, &checkpointMsg); err != nil {
+			return decodeFailed(header, err)
+		}
+		return node.signedBySender(in, header, checkpointMsg.NodeID) && node.verifyReplicaMsg(hCheckpoint, checkpointMsg.NodeID, checkpointMsg, sig)
+	case hViewChange:
+		var viewChangeMsg ViewChangeMsg
+		if err := json.Unmarshal(payload, &viewChangeMsg); err != nil {
+			return decodeFailed(header, err)
+		}
+		if !node.signedBySender(in, header, viewChangeMsg.NodeID) {
+			return false
+		}
+		if !node.verifyViewChange(&SignedViewChangeMsg{viewChangeMsg, sig}) {
+			node.rejectReplicaMsg(hViewChange, viewChangeMsg.NodeID, "invalid signature or certificate")
+			return false
+		}
+	case hNewView:
+		var newViewMsg NewViewMsg
+		if err := json.Unmarshal(payload, &newViewMsg); err != nil {
+			return decodeFailed(header, err)
+		}
+		return node.signedBySender(in, header, newViewMsg.NodeID) && node.verifyNewView(&newViewMsg, sig)
+	default:
+		return false
+	}
+	return true
+}
+
+// signedBySender tells whether a message names the replica it arrived from as its signer,
+// so a replica cannot fill the lane or the rejection counters of another one
+func (node *Node) signedBySender(in *inboundMsg, header HeaderMsg, signer int) bool {
+	if signer != in.sender {
+		node.rejectReplicaMsg(header, in.sender, fmt.Sprintf("signed as replica %d", signer))
+		return false
+	}
+	return true
+}
+
+func decodeFailed(header HeaderMsg, err error) bool {
+	Logger.Errorf("Error decoding %s:%v", header, err)
+	return false
+}
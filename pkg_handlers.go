@@ -4,19 +4,25 @@ import (
 	getty "github.com/apache/dubbo-getty"
 )
 
+// DefaultPackageHandler splits the byte stream of a session into framed messages
 type DefaultPackageHandler struct{}
 
 func (h *DefaultPackageHandler) Read(ss getty.Session, data []byte) (interface{}, int, error) {
 	/*
-		package handling done via node
+		a zero length tells getty to wait for more bytes,
+		an error closes the session
 	*/
-	return data, len(data), nil
+	payload, length, err := DecodeFrame(data)
+	if err != nil {
+		Logger.Errorf("Invalid frame from %s: %v", ss.RemoteAddr(), err)
+		return nil, 0, err
+	}
+	if length == 0 {
+		return nil, 0, nil
+	}
+	return payload, length, nil
 }
 
 func (h *DefaultPackageHandler) Write(ss getty.Session, p interface{}) ([]byte, error) {
-
-	/*
-		package handling done via node
-	*/
-	return p.([]byte), nil
+	return EncodeFrame(p.([]byte)), nil
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	getty "github.com/apache/dubbo-getty"
+)
+
+// fakeSession only provides the address the package handler logs
+type fakeSession struct {
+	getty.Session
+}
+
+func (s *fakeSession) RemoteAddr() string {
+	return "127.0.0.1:1"
+}
+
+// readAll feeds a byte stream to the handler in chunks of size, the way getty
+// hands over what a session received, and collects the messages
+func readAll(t *testing.T, stream []byte, size int) ([][]byte, error) {
+	handler := &DefaultPackageHandler{}
+	session := &fakeSession{}
+	var buffered []byte
+	msgs := [][]byte{}
+	for len(stream) > 0 || len(buffered) > 0 {
+		if len(stream) > 0 {
+			n := size
+			if n > len(stream) {
+				n = len(stream)
+			}
+			buffered = append(buffered, stream[:n]...)
+			stream = stream[n:]
+		}
+		for {
+			pkg, length, err := handler.Read(session, buffered)
+			if err != nil {
+				return msgs, err
+			}
+			if length == 0 {
+				break
+			}
+			msgs = append(msgs, pkg.([]byte))
+			buffered = buffered[length:]
+		}
+		if len(stream) == 0 && len(buffered) > 0 {
+			t.Fatalf("%d bytes left over", len(buffered))
+		}
+	}
+	return msgs, nil
+}
+
+func TestPackageHandlerRead(t *testing.T) {
+	withMaxFrameSize(t, 64)
+	handler := &DefaultPackageHandler{}
+	frames := [][]byte{}
+	stream := []byte{}
+	for _, msg := range []string{"hello", "", "world"} {
+		frame, err := handler.Write(nil, []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, []byte(msg))
+		stream = append(stream, frame...)
+	}
+	// one byte at a time splits every header and payload, the whole stream coalesces the frames
+	for _, size := range []int{1, 2, 5, 7, len(stream)} {
+		msgs, err := readAll(t, stream, size)
+		if err != nil {
+			t.Fatalf("chunks of %d: %v", size, err)
+		}
+		if len(msgs) != len(frames) {
+			t.Fatalf("chunks of %d: read %d messages, want %d", size, len(msgs), len(frames))
+		}
+		for i := range msgs {
+			if !bytes.Equal(msgs[i], frames[i]) {
+				t.Fatalf("chunks of %d: message %d is %q, want %q", size, i, msgs[i], frames[i])
+			}
+		}
+	}
+}
+
+func TestPackageHandlerRejects(t *testing.T) {
+	withMaxFrameSize(t, 64)
+	valid := EncodeFrame([]byte("hello"))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"bad magic", rawFrame(0x00, frameVersion, 5, []byte("hello"))},
+		{"bad version", rawFrame(frameMagic, frameVersion+1, 5, []byte("hello"))},
+		{"oversized length", rawFrame(frameMagic, frameVersion, 65, nil)},
+		{"bad frame after a valid one", append(append([]byte{}, valid...), rawFrame(0x00, frameVersion, 0, nil)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readAll(t, tt.data, 1); err == nil {
+				t.Fatal("stream accepted")
+			}
+		})
+	}
+}
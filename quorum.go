@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const weightsOperation = "weights"
+
+// quorumSystem weighs the votes of the replicas like WHEAT: with n = 3f+1+δ replicas,
+// 2f of them get a larger weight so a quorum forms from fewer, faster replicas. The base
+// weights come from hosts.config, a replica is indexed by its node id. A weighted quorum
+// holds more than half of the total weight plus the weight of the f heaviest replicas,
+// so two of them share a correct replica, and more than twice the weight of the f
+// heaviest replicas, so it shares a correct replica with any n-f replicas as well
+type quorumSystem struct {
+	base      []int
+	total     int
+	faulty    int // weight of the f heaviest replicas
+	threshold int
+}
+
+func newQuorumSystem(replicas []*NodeInfo, f int) (*quorumSystem, error) {
+	base := make([]int, len(replicas))
+	for _, replica := range replicas {
+		if replica.nodeID < 0 || replica.nodeID >= len(replicas) {
+			return nil, fmt.Errorf("replica ids must run from 0 to %d", len(replicas)-1)
+		}
+		base[replica.nodeID] = replica.weight
+	}
+	sorted := append([]int{}, base...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	q := &quorumSystem{base: base}
+	for i, weight := range sorted {
+		q.total += weight
+		if i < f {
+			q.faulty += weight
+		}
+	}
+	q.threshold = (q.total+q.faulty)/2 + 1
+	if q.threshold > q.total-q.faulty {
+		return nil, fmt.Errorf("the correct replicas cannot form a quorum of weight %d", q.threshold)
+	}
+	if q.threshold <= 2*q.faulty {
+		return nil, fmt.Errorf("a quorum of weight %d does not outweigh twice the %d faulty replicas can hold", q.threshold, q.faulty)
+	}
+	return q, nil
+}
+
+// resolve returns the weights of an assignment, nil stands for the base weights
+func (q *quorumSystem) resolve(weights []int) []int {
+	if weights == nil {
+		return q.base
+	}
+	return weights
+}
+
+// isQuorum tells whether the voters hold a quorum under weights
+func (q *quorumSystem) isQuorum(weights []int, voters map[int]bool) bool {
+	weights = q.resolve(weights)
+	sum := 0
+	for nodeID, voted := range voters {
+		if voted && nodeID >= 0 && nodeID < len(weights) {
+			sum += weights[nodeID]
+		}
+	}
+	return sum >= q.threshold
+}
+
+// validAssignment tells whether weights only moves the base weights between replicas,
+// which keeps the weight the f heaviest replicas can hold, and with it the intersections
+func (q *quorumSystem) validAssignment(weights []int) bool {
+	if weights == nil {
+		return true
+	}
+	if len(weights) != len(q.base) {
+		return false
+	}
+	a := append([]int{}, weights...)
+	b := append([]int{}, q.base...)
+	sort.Ints(a)
+	sort.Ints(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *quorumSystem) sameWeights(a []int, b []int) bool {
+	a, b = q.resolve(a), q.resolve(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// the smallest weight, replicas above it are the heavy ones
+func (q *quorumSystem) minWeight() int {
+	lightest := q.base[0]
+	for _, weight := range q.base {
+		if weight < lightest {
+			lightest = weight
+		}
+	}
+	return lightest
+}
+
+// voters turns a vote log into a voter set that includes extra
+func voters(votes map[int]bool, extra ...int) map[int]bool {
+	set := make(map[int]bool, len(votes)+len(extra))
+	for nodeID, voted := range votes {
+		set[nodeID] = voted
+	}
+	for _, nodeID := range extra {
+		set[nodeID] = true
+	}
+	return set
+}
+
+// adaptiveWeights lets the primary move the large weights away from stragglers,
+// like AWARE, enabled by the adaptiveWeights key of system config
+func adaptiveWeights() bool {
+	return SystemConfig["adaptiveWeights"] == 1 && !hotstuffMode()
+}
+
+// weightEpoch is a weight assignment in force from a sequence number on
+type weightEpoch struct {
+	FromSeq int   `json:"fromSeq"`
+	Weights []int `json:"weights"`
+}
+
+// weightLag is how far behind its execution a new assignment takes effect. A replica
+// that executed up to s knows the weights of every sequence number up to s+weightLag,
+// which covers the watermark window of its stable checkpoint
+func (node *Node) weightLag() int {
+	return watermarkWindow * node.period
+}
+
+// weightsFor returns the weights a pre-prepare for seq must carry, nil for the base
+// weights, it fails when the replica did not execute far enough to know them,
+// must be called with node.mutex held
+func (node *Node) weightsFor(seq int) ([]int, bool) {
+	if !adaptiveWeights() {
+		return nil, true
+	}
+	if node.lastExecuted < seq-node.weightLag() {
+		return nil, false
+	}
+	var weights []int
+	for _, epoch := range node.weightEpochs {
+		if epoch.FromSeq <= seq {
+			weights = epoch.Weights
+		}
+	}
+	return weights, true
+}
+
+// latestWeights is the last scheduled assignment, possibly not yet in force,
+// must be called with node.mutex held
+func (node *Node) latestWeights() []int {
+	if len(node.weightEpochs) == 0 {
+		return nil
+	}
+	return node.weightEpochs[len(node.weightEpochs)-1].Weights
+}
+
+// pruneWeightEpochs drops the assignments superseded at seq,
+// must be called with node.mutex held
+func (node *Node) pruneWeightEpochs(seq int) []weightEpoch {
+	start := 0
+	for i, epoch := range node.weightEpochs {
+		if epoch.FromSeq <= seq+1 {
+			start = i
+		}
+	}
+	return node.weightEpochs[start:]
+}
+
+// proposeWeights orders a new assignment when a heavy replica became a straggler,
+// the replicas are ranked by their latency score with the primary first. Backups trust
+// the ranking of the primary: any permutation of the base weights keeps the quorums
+// intersecting, so a faulty primary that hands the large weights to slow replicas
+// costs performance but not safety, until a view change replaces it
+func (node *Node) proposeWeights() {
+	if !adaptiveWeights() {
+		return
+	}
+	node.mutex.Lock()
+	current := node.quorum.resolve(node.latestWeights())
+	view := node.View
+	stable := node.stableSeqID
+	node.mutex.Unlock()
+	slow := false
+	for nodeID, weight := range current {
+		if weight > node.quorum.minWeight() && nodeID != node.nodeID && node.latency.IsStraggler(nodeID) {
+			slow = true
+		}
+	}
+	if !slow {
+		return
+	}
+	ranked := make([]int, len(current))
+	for i := range ranked {
+		ranked[i] = i
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a == node.nodeID || b == node.nodeID {
+			return a == node.nodeID
+		}
+		return node.latency.Score(a) < node.latency.Score(b)
+	})
+	sorted := append([]int{}, node.quorum.base...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	next := make([]int, len(current))
+	for i, nodeID := range ranked {
+		next[nodeID] = sorted[i]
+	}
+	if node.quorum.sameWeights(next, current) {
+		return
+	}
+	Logger.Infof("Proposing the weights %v instead of %v", next, current)
+	node.propose([]SignedRequestMsg{{newWeightsRequest(view, stable, next), []byte{}}})
+}
+
+// newWeightsRequest builds the system request carrying an assignment,
+// like a null request it has no client and no signature
+func newWeightsRequest(view int, stable int, weights []int) RequestMsg {
+	parts := make([]string, len(weights))
+	for i, weight := range weights {
+		parts[i] = strconv.Itoa(weight)
+	}
+	msg := fmt.Sprintf("%s-%d-%d %s", weightsOperation, view, stable, strings.Join(parts, ","))
+	return RequestMsg{
+		weightsOperation,
+		0,
+		-1,
+		Request{
+			msg,
+			hex.EncodeToString(generateDigest(msg)),
+		},
+	}
+}
+
+func isWeightsRequest(request *RequestMsg) bool {
+	return request.Operation == weightsOperation && request.ClientID < 0
+}
+
+// isSystemRequest tells requests the replicas order for themselves from client requests
+func isSystemRequest(request *RequestMsg) bool {
+	return isNullRequest(request) || isWeightsRequest(request)
+}
+
+// applyWeights schedules the assignment of a weights request executed at seq, a
+// request that does not only move the base weights around is ignored by every replica,
+// must be called with node.mutex held
+func (node *Node) applyWeights(request *RequestMsg, seq int) {
+	if !adaptiveWeights() {
+		return
+	}
+	fields := strings.Fields(request.CRequest.Message)
+	if len(fields) != 2 {
+		return
+	}
+	weights := []int{}
+	for _, part := range strings.Split(fields[1], ",") {
+		weight, err := strconv.Atoi(part)
+		if err != nil {
+			return
+		}
+		weights = append(weights, weight)
+	}
+	if !node.quorum.validAssignment(weights) || node.quorum.sameWeights(weights, node.latestWeights()) {
+		return
+	}
+	for nodeID, weight := range weights {
+		if weight > node.quorum.minWeight() && nodeID != node.nodeID && node.latency.IsStraggler(nodeID) {
+			Logger.Warnf("Weights %v give a large weight to straggler %d", weights, nodeID)
+		}
+	}
+	from := seq + node.weightLag()
+	node.weightEpochs = append(node.weightEpochs, weightEpoch{from, weights})
+	Logger.Infof("Weights %v take effect at sequence %d", weights, from)
+}
+
+// snapshotWeights is the weight schedule a checkpoint carries, replicas that catch up
+// through it need the schedule to check the next pre-prepares,
+// must be called with node.mutex held
+func (node *Node) snapshotWeights() []weightEpoch {
+	if !adaptiveWeights() {
+		return nil
+	}
+	return node.pruneWeightEpochs(node.lastExecuted)
+}
+
+// restoreWeights installs the weight schedule of a checkpoint,
+// must be called with node.mutex held
+func (node *Node) restoreWeights(epochs []weightEpoch) {
+	if adaptiveWeights() {
+		node.weightEpochs = epochs
+	}
+}
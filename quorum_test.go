@@ -0,0 +1,120 @@
+package main
+
+import "testing"
+
+func weightedReplicas(weights ...int) []*NodeInfo {
+	replicas := make([]*NodeInfo, len(weights))
+	for i, weight := range weights {
+		replicas[i] = &NodeInfo{nodeID: i, weight: weight}
+	}
+	return replicas
+}
+
+// subsets returns every set of replicas out of n
+func subsets(n int) []map[int]bool {
+	sets := []map[int]bool{}
+	for mask := 0; mask < 1<<n; mask++ {
+		set := make(map[int]bool)
+		for i := 0; i < n; i++ {
+			if mask&(1<<i) != 0 {
+				set[i] = true
+			}
+		}
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+func TestNewQuorumSystem(t *testing.T) {
+	tests := []struct {
+		name      string
+		weights   []int
+		f         int
+		threshold int
+		valid     bool
+	}{
+		{"n=4 f=1", []int{1, 1, 1, 1}, 1, 3, true},
+		{"n=5 f=1 weighted", []int{2, 2, 1, 1, 1}, 1, 5, true},
+		{"n=6 f=1 weighted", []int{2, 2, 1, 1, 1, 1}, 1, 6, true},
+		{"n=7 f=2", []int{1, 1, 1, 1, 1, 1, 1}, 2, 5, true},
+		{"heaviest replica outweighs the others", []int{3, 1, 1, 1}, 1, 0, false},
+		{"n=3 f=1", []int{1, 1, 1}, 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := newQuorumSystem(weightedReplicas(tt.weights...), tt.f)
+			if !tt.valid {
+				if err == nil {
+					t.Fatalf("weights %v accepted with threshold %d", tt.weights, q.threshold)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.threshold != tt.threshold {
+				t.Fatalf("threshold %d, want %d", q.threshold, tt.threshold)
+			}
+			n := len(tt.weights)
+			quorums := []map[int]bool{}
+			for _, set := range subsets(n) {
+				if q.isQuorum(nil, set) {
+					quorums = append(quorums, set)
+				} else if len(set) >= n-tt.f {
+					t.Fatalf("the %d replicas %v do not form a quorum", len(set), set)
+				}
+			}
+			// two quorums share more than f replicas, so a correct one
+			for _, a := range quorums {
+				for _, b := range quorums {
+					shared := 0
+					for nodeID := range a {
+						if b[nodeID] {
+							shared++
+						}
+					}
+					if shared <= tt.f {
+						t.Fatalf("quorums %v and %v share %d replicas", a, b, shared)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestValidAssignment(t *testing.T) {
+	q, err := newQuorumSystem(weightedReplicas(2, 2, 1, 1, 1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		weights []int
+		valid   bool
+	}{
+		{nil, true},
+		{[]int{1, 1, 1, 2, 2}, true},
+		{[]int{2, 1, 2, 1, 1}, true},
+		{[]int{2, 2, 2, 1, 1}, false},
+		{[]int{3, 1, 1, 1, 1}, false},
+		{[]int{2, 2, 1, 1}, false},
+	}
+	for _, tt := range tests {
+		if got := q.validAssignment(tt.weights); got != tt.valid {
+			t.Errorf("validAssignment(%v) = %v, want %v", tt.weights, got, tt.valid)
+		}
+	}
+}
+
+func TestIsQuorumUnderAssignment(t *testing.T) {
+	q, err := newQuorumSystem(weightedReplicas(2, 2, 1, 1, 1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := []int{1, 1, 1, 2, 2}
+	if q.isQuorum(moved, map[int]bool{0: true, 1: true, 2: true}) {
+		t.Fatal("replicas 0 1 2 lost their weight but still form a quorum")
+	}
+	if !q.isQuorum(moved, map[int]bool{2: true, 3: true, 4: true}) {
+		t.Fatal("replicas 2 3 4 carry the large weights but do not form a quorum")
+	}
+}
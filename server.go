@@ -7,6 +7,8 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"sr-bft/state"
 )
 
 type Server struct {
@@ -14,10 +16,25 @@ type Server struct {
 	hub  *NetworkingHub
 }
 
+// applications selectable with the app key of system.config
+const (
+	appEcho    = 0
+	appKVStore = 1
+)
+
+func newApplication(kind int) state.Application {
+	switch kind {
+	case appKVStore:
+		return state.NewKVStore()
+	default:
+		return state.NewState()
+	}
+}
+
 func NewServer(nodeId int) *Server {
 	// A server has a node and a communication hub
-	PrivateKey = ReadPrivateKey("./config/keys", nodeId)
-	newNode := NewNode(nodeId)
+	PrivateKey = ReadPrivateKey(replicaKeysPath, nodeId)
+	newNode := NewNode(nodeId, newApplication(SystemConfig["app"]))
 	newHub := NewNetworkingHub(newNode)
 
 	server := &Server{
@@ -49,6 +66,9 @@ func (s *Server) Start() {
 	// wait until all the nodes are connected
 	time.Sleep(10 * time.Second)
 
+	// a restarted replica catches up with its peers
+	s.node.requestStateTransfer()
+
 	if s.node.nodeID == 0 {
 		go s.testClient()
 	}
@@ -66,36 +86,38 @@ func (s *Server) Start() {
 
 	// Block the main goroutine until a value is received on the 'done' channel.
 	<-done
+	fmt.Printf("Rejected messages:\n%s", s.node.VerificationStats())
+	fmt.Printf("Straggler scores:\n%s", s.node.LatencyMonitor())
 	fmt.Println("Program stopped.")
 }
 
 func (s *Server) testClient() {
-	// Generate 100 requests
-	req_size := 1024
-	msgb := make([]byte, req_size)
-	for i := 0; i < 1024; i++ {
-		msgb[i] = "a"[0]
-	}
-
-	msg := "Hello, World!"
-	digest := hex.EncodeToString(generateDigest(msg))
-
-	req := Request{
-		msg,
-		digest,
-	}
-	reqmsg := &RequestMsg{
-		"Operation",
-		0,
-		10,
-		req,
-	}
-	sig, _ := signMessage(reqmsg, PrivateKey)
-	//req_msg := ComposeMsg(hRequest, reqmsg, sig)
+	// requests are sent on behalf of client 0
+	clientKey := ReadPrivateKey(clientKeysPath, 0)
 	for i := 0; i < 4; i++ {
-		reqmsg.Timestamp = int(time.Now().Unix())
+		msg := state.EncodeKVCommand(state.KVCommand{
+			Key:   fmt.Sprintf("test-%d", i),
+			Value: "Hello, World!",
+		})
+		digest := hex.EncodeToString(generateDigest(msg))
+
+		req := Request{
+			msg,
+			digest,
+		}
+		reqmsg := &RequestMsg{
+			state.OpPut,
+			int(time.Now().UnixNano()),
+			0,
+			req,
+		}
+		sig, err := signMessage(reqmsg, clientKey)
+		if err != nil {
+			Logger.Errorf("Test client cannot sign its requests:%v", err)
+			return
+		}
 		req_msg := ComposeMsg(hRequest, reqmsg, sig)
-		s.node.msgQueue <- req_msg
+		s.node.submitClient(nil, req_msg)
 		//time.Sleep(1000 * time.Microsecond)
 
 	}
@@ -6,15 +6,15 @@ import (
 
 var (
 	nodeIdFlag = &cli.IntFlag{
-		Name:	"id",
-		Usage:	"id",
+		Name:     "id",
+		Usage:    "id",
 		Required: true,
 	}
 	nodeSubCommand = &cli.Command{
-		Name:		 "node",
-		Usage: 		 "start pbft node",
+		Name:        "node",
+		Usage:       "start pbft node",
 		Description: "start pbft node",
-		ArgsUsage: 	 "<id>",
+		ArgsUsage:   "<id>",
 		Flags: []cli.Flag{
 			nodeIdFlag,
 		},
@@ -25,26 +25,34 @@ var (
 			return nil
 		},
 	}
+	clientIdFlag = &cli.IntFlag{
+		Name:  "id",
+		Usage: "client id, its keys are read from config/client_keys",
+		Value: 0,
+	}
 	clientSubCommand = &cli.Command{
-		Name:		 "client",
-		Usage: 		 "start pbft client",
+		Name:        "client",
+		Usage:       "start pbft client",
 		Description: "start pbft client",
-		ArgsUsage: 	 "",
+		ArgsUsage:   "",
+		Flags: []cli.Flag{
+			clientIdFlag,
+		},
 		Action: func(c *cli.Context) error {
-			client := NewClient()
+			client := NewClient(c.Int("id"))
 			client.Start()
 			return nil
 		},
 	}
 	PBFTCommand = &cli.Command{
-		Name:	"pbft",
-		Usage:	"pbft commands",
-		ArgsUsage: "",
-		Category: "pbft Commands",
+		Name:        "pbft",
+		Usage:       "pbft commands",
+		ArgsUsage:   "",
+		Category:    "pbft Commands",
 		Description: "",
 		Subcommands: []*cli.Command{
 			nodeSubCommand,
 			clientSubCommand,
 		},
 	}
-)
\ No newline at end of file
+)
@@ -11,7 +11,7 @@ type ConsensusSessionHandler struct {
 
 func (h *ConsensusSessionHandler) OnOpen(session getty.Session) error {
 	Logger.Infof("New consensus connection from %s", session.RemoteAddr())
-	h.hub.consensusConnections = append(h.hub.consensusConnections, &session)
+	h.hub.startHandshake(session)
 	return nil
 }
 
@@ -21,21 +21,31 @@ func (h *ConsensusSessionHandler) OnError(session getty.Session, err error) {
 
 func (h *ConsensusSessionHandler) OnClose(session getty.Session) {
 	Logger.Infof("Consensus connection from %s closed", session.RemoteAddr())
-	// Remove the session from the hub or replace it will nil?
-	h.hub.mu.Lock()
-	defer h.hub.mu.Unlock()
-	for i, s := range h.hub.consensusConnections {
-		if s == &session {
-			h.hub.consensusConnections[i] = nil
-			break
-		}
+	nodeID, ok := peerOf(session)
+	if !ok {
+		return
 	}
+	h.hub.removePeer(nodeID, session)
 }
 
 func (h *ConsensusSessionHandler) OnMessage(session getty.Session, pkg interface{}) {
 	// Debug:  Logger.Debugf("Received message from %s", session.RemoteAddr())
 	msg := pkg.([]byte)
-	h.hub.node.msgQueue <- msg
+	header, payload, sig := SplitMsg(msg)
+	switch header {
+	case hHello:
+		h.hub.handleHello(session, payload, sig)
+		return
+	case hHelloAck:
+		h.hub.handleHelloAck(session, payload, sig)
+		return
+	}
+	nodeID, ok := peerOf(session)
+	if !ok {
+		Logger.Warnf("Dropping %s from unauthenticated session %s", header, session.RemoteAddr())
+		return
+	}
+	h.hub.node.submit(nodeID, msg)
 }
 
 func (h *ConsensusSessionHandler) OnCron(session getty.Session) {}
@@ -45,11 +55,41 @@ type StateTransferSessionHandler struct {
 	hub *NetworkingHub
 }
 
-func (h *StateTransferSessionHandler) OnOpen(session getty.Session) error               { return nil }
-func (h *StateTransferSessionHandler) OnError(session getty.Session, err error)         {}
-func (h *StateTransferSessionHandler) OnClose(session getty.Session)                    {}
-func (h *StateTransferSessionHandler) OnMessage(session getty.Session, pkg interface{}) {}
-func (h *StateTransferSessionHandler) OnCron(session getty.Session)                     {}
+func (h *StateTransferSessionHandler) OnOpen(session getty.Session) error {
+	Logger.Infof("New state transfer connection from %s", session.RemoteAddr())
+	h.hub.mu.Lock()
+	defer h.hub.mu.Unlock()
+	h.hub.stateTransferConnections = append(h.hub.stateTransferConnections, session)
+	return nil
+}
+
+func (h *StateTransferSessionHandler) OnError(session getty.Session, err error) {
+	Logger.Errorf("Error on state transfer connection from %s: %v", session.RemoteAddr(), err)
+}
+
+func (h *StateTransferSessionHandler) OnClose(session getty.Session) {
+	Logger.Infof("State transfer connection from %s closed", session.RemoteAddr())
+	h.hub.mu.Lock()
+	defer h.hub.mu.Unlock()
+	for i, s := range h.hub.stateTransferConnections {
+		if s == session {
+			h.hub.stateTransferConnections = append(h.hub.stateTransferConnections[:i], h.hub.stateTransferConnections[i+1:]...)
+			break
+		}
+	}
+}
+
+func (h *StateTransferSessionHandler) OnMessage(session getty.Session, pkg interface{}) {
+	msg := pkg.([]byte)
+	h.hub.node.stateTransferQueue <- &stateTransferPkg{
+		msg,
+		func(reply []byte) {
+			session.Send(reply)
+		},
+	}
+}
+
+func (h *StateTransferSessionHandler) OnCron(session getty.Session) {}
 
 // -------------------------------------------------Client Session Handlers ---------------------------------------------------------------------------------
 type ClientSessionHandler struct {
@@ -65,9 +105,12 @@ func (h *ClientSessionHandler) OnError(session getty.Session, err error) {
 }
 func (h *ClientSessionHandler) OnClose(session getty.Session) {
 	Logger.Infof("Client connection from %s closed", session.RemoteAddr())
+	h.hub.unregisterClients(session)
 }
 func (h *ClientSessionHandler) OnMessage(session getty.Session, pkg interface{}) {
 	msg := pkg.([]byte)
-	h.hub.node.msgQueue <- msg
+	// the session is bound to a client by the verification stage, a request
+	// that does not verify must not redirect the replies of the client it claims
+	h.hub.node.submitClient(session, msg)
 }
 func (h *ClientSessionHandler) OnCron(session getty.Session) {}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"math/big"
+)
+
+// signature schemes, selected with the sigScheme key of system config
+const (
+	schemeEd25519 = 0
+	schemeECDSA   = 1 // ECDSA over P-256
+)
+
+// Signer signs message digests with the private key of a replica or a client
+type Signer interface {
+	Sign(digest []byte) ([]byte, error)
+	Scheme() int
+	// CryptoSigner exposes the key to the standard library, e.g. for TLS certificates
+	CryptoSigner() crypto.Signer
+}
+
+// Verifier checks signatures with the public key of a replica or a client
+type Verifier interface {
+	Verify(digest []byte, sig []byte) bool
+	Scheme() int
+	// SignatureSize is the length of every signature of the scheme
+	SignatureSize() int
+	// Equal tells whether pub is this public key
+	Equal(pub crypto.PublicKey) bool
+}
+
+func signatureScheme() int {
+	return SystemConfig["sigScheme"]
+}
+
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+func (s *ed25519Signer) Sign(digest []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, digest), nil
+}
+
+func (s *ed25519Signer) Scheme() int {
+	return schemeEd25519
+}
+
+func (s *ed25519Signer) CryptoSigner() crypto.Signer {
+	return s.key
+}
+
+type ed25519Verifier struct {
+	key ed25519.PublicKey
+}
+
+func (v *ed25519Verifier) Verify(digest []byte, sig []byte) bool {
+	if len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(v.key, digest, sig)
+}
+
+func (v *ed25519Verifier) Scheme() int {
+	return schemeEd25519
+}
+
+func (v *ed25519Verifier) SignatureSize() int {
+	return ed25519.SignatureSize
+}
+
+func (v *ed25519Verifier) Equal(pub crypto.PublicKey) bool {
+	return v.key.Equal(pub)
+}
+
+// ECDSA signatures are r || s, each padded to the size of the curve,
+// so they have a fixed length like ed25519 ones
+type ecdsaSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s *ecdsaSigner) Sign(digest []byte) ([]byte, error) {
+	r, sv, err := ecdsa.Sign(rand.Reader, s.key, digest)
+	if err != nil {
+		return nil, err
+	}
+	size := (s.key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	sv.FillBytes(sig[size:])
+	return sig, nil
+}
+
+func (s *ecdsaSigner) Scheme() int {
+	return schemeECDSA
+}
+
+func (s *ecdsaSigner) CryptoSigner() crypto.Signer {
+	return s.key
+}
+
+type ecdsaVerifier struct {
+	key *ecdsa.PublicKey
+}
+
+func (v *ecdsaVerifier) Verify(digest []byte, sig []byte) bool {
+	size := v.SignatureSize() / 2
+	if len(sig) != 2*size {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	return ecdsa.Verify(v.key, digest, r, s)
+}
+
+func (v *ecdsaVerifier) Scheme() int {
+	return schemeECDSA
+}
+
+func (v *ecdsaVerifier) SignatureSize() int {
+	return 2 * ((v.key.Curve.Params().BitSize + 7) / 8)
+}
+
+func (v *ecdsaVerifier) Equal(pub crypto.PublicKey) bool {
+	return v.key.Equal(pub)
+}
+
+// newSigner wraps a parsed private key, nil when the key does not belong to a supported scheme
+func newSigner(key interface{}) Signer {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return &ed25519Signer{k}
+	case *ecdsa.PrivateKey:
+		return &ecdsaSigner{k}
+	}
+	return nil
+}
+
+func newVerifier(key interface{}) Verifier {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return &ed25519Verifier{k}
+	case *ecdsa.PublicKey:
+		return &ecdsaVerifier{k}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// operations understood by the key-value store, carried in RequestMsg.Operation
+const (
+	OpGet    = "GET"
+	OpPut    = "PUT"
+	OpDelete = "DELETE"
+	OpCAS    = "CAS"
+)
+
+// results returned to the client besides the value of a GET
+const (
+	ResultOK       = "OK"
+	ResultNotFound = "NOT_FOUND"
+	ResultFailed   = "FAILED"
+	ResultError    = "ERROR"
+)
+
+// KVCommand holds the arguments of an operation, carried JSON encoded in Request.Message
+type KVCommand struct {
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Expected string `json:"expected,omitempty"` // CAS only, empty means the key must be absent
+	Nonce    int64  `json:"nonce,omitempty"`    // tells repeated commands apart, ignored by the store
+}
+
+// EncodeKVCommand builds the request message of an operation
+func EncodeKVCommand(cmd KVCommand) string {
+	bcmd, _ := json.Marshal(cmd)
+	return string(bcmd)
+}
+
+// KVStore is a deterministic in-memory key-value store
+type KVStore struct {
+	data map[string]string
+}
+
+// NewKVStore creates an empty store
+func NewKVStore() *KVStore {
+	return &KVStore{
+		data: make(map[string]string),
+	}
+}
+
+// Execute applies GET, PUT, DELETE and CAS operations
+func (kv *KVStore) Execute(operation string, message string) string {
+	var cmd KVCommand
+	err := json.Unmarshal([]byte(message), &cmd)
+	if err != nil {
+		return fmt.Sprintf("%s: invalid command", ResultError)
+	}
+
+	switch operation {
+	case OpGet:
+		value, ok := kv.data[cmd.Key]
+		if !ok {
+			return ResultNotFound
+		}
+		return value
+	case OpPut:
+		kv.data[cmd.Key] = cmd.Value
+		return ResultOK
+	case OpDelete:
+		if _, ok := kv.data[cmd.Key]; !ok {
+			return ResultNotFound
+		}
+		delete(kv.data, cmd.Key)
+		return ResultOK
+	case OpCAS:
+		current, ok := kv.data[cmd.Key]
+		if (cmd.Expected == "" && ok) || (cmd.Expected != "" && current != cmd.Expected) {
+			return fmt.Sprintf("%s: %s", ResultFailed, current)
+		}
+		kv.data[cmd.Key] = cmd.Value
+		return ResultOK
+	default:
+		return fmt.Sprintf("%s: unknown operation %s", ResultError, operation)
+	}
+}
+
+// Snapshot encodes the store, keys are sorted so equal stores give equal snapshots
+func (kv *KVStore) Snapshot() ([]byte, error) {
+	return json.Marshal(kv.data)
+}
+
+// Restore replaces the store content with a snapshot
+func (kv *KVStore) Restore(snapshot []byte) error {
+	var data map[string]string
+	if len(snapshot) > 0 {
+		err := json.Unmarshal(snapshot, &data)
+		if err != nil {
+			return err
+		}
+	}
+	if data == nil {
+		// an empty snapshot, or a JSON null
+		data = make(map[string]string)
+	}
+	kv.data = data
+	return nil
+}
@@ -0,0 +1,118 @@
+package state
+
+import (
+	"bytes"
+	"testing"
+)
+
+func put(key string, value string) string {
+	return EncodeKVCommand(KVCommand{Key: key, Value: value})
+}
+
+func TestKVStoreExecute(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		message   string
+		result    string
+	}{
+		{"get of a missing key", OpGet, put("a", ""), ResultNotFound},
+		{"delete of a missing key", OpDelete, put("a", ""), ResultNotFound},
+		{"put", OpPut, put("a", "1"), ResultOK},
+		{"get", OpGet, put("a", ""), "1"},
+		{"put overwrites", OpPut, put("a", "2"), ResultOK},
+		{"get of the new value", OpGet, put("a", ""), "2"},
+		{"cas with a stale value", OpCAS, EncodeKVCommand(KVCommand{Key: "a", Value: "3", Expected: "1"}), ResultFailed + ": 2"},
+		{"value kept after a failed cas", OpGet, put("a", ""), "2"},
+		{"cas", OpCAS, EncodeKVCommand(KVCommand{Key: "a", Value: "3", Expected: "2"}), ResultOK},
+		{"get after cas", OpGet, put("a", ""), "3"},
+		{"cas expecting absence of a present key", OpCAS, EncodeKVCommand(KVCommand{Key: "a", Value: "4"}), ResultFailed + ": 3"},
+		{"cas expecting absence", OpCAS, EncodeKVCommand(KVCommand{Key: "b", Value: "1"}), ResultOK},
+		{"cas expecting a value of a missing key", OpCAS, EncodeKVCommand(KVCommand{Key: "c", Value: "1", Expected: "0"}), ResultFailed + ": "},
+		{"delete", OpDelete, put("a", ""), ResultOK},
+		{"get after delete", OpGet, put("a", ""), ResultNotFound},
+		{"nonce is ignored", OpGet, EncodeKVCommand(KVCommand{Key: "b", Nonce: 42}), "1"},
+		{"invalid command", OpPut, "not json", ResultError + ": invalid command"},
+		{"unknown operation", "INCR", put("b", ""), ResultError + ": unknown operation INCR"},
+	}
+	kv := NewKVStore()
+	// the cases run in order on the same store
+	for _, tt := range tests {
+		if result := kv.Execute(tt.operation, tt.message); result != tt.result {
+			t.Fatalf("%s: %s returned %q, want %q", tt.name, tt.operation, result, tt.result)
+		}
+	}
+}
+
+func TestKVStoreSnapshotRestore(t *testing.T) {
+	kv := NewKVStore()
+	for _, key := range []string{"c", "a", "b", "d"} {
+		kv.Execute(OpPut, put(key, "value-"+key))
+	}
+	kv.Execute(OpDelete, put("d", ""))
+	snapshot, err := kv.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewKVStore()
+	restored.Execute(OpPut, put("stale", "x"))
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if value := restored.Execute(OpGet, put(key, "")); value != "value-"+key {
+			t.Fatalf("restored %s=%q", key, value)
+		}
+	}
+	for _, key := range []string{"d", "stale"} {
+		if value := restored.Execute(OpGet, put(key, "")); value != ResultNotFound {
+			t.Fatalf("restored store holds %s=%q", key, value)
+		}
+	}
+
+	// checkpoint digests are taken over snapshots: the same content in another
+	// insertion order gives the same bytes, and so does a restored store
+	again, err := restored.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reordered := NewKVStore()
+	for _, key := range []string{"b", "c", "a"} {
+		reordered.Execute(OpPut, put(key, "value-"+key))
+	}
+	other, err := reordered.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(snapshot, again) || !bytes.Equal(snapshot, other) {
+		t.Fatalf("snapshots differ: %s, %s, %s", snapshot, again, other)
+	}
+}
+
+func TestKVStoreRestoreEmpty(t *testing.T) {
+	for _, snapshot := range [][]byte{nil, []byte("{}"), []byte("null")} {
+		kv := NewKVStore()
+		kv.Execute(OpPut, put("a", "1"))
+		if err := kv.Restore(snapshot); err != nil {
+			t.Fatalf("restore %q: %v", snapshot, err)
+		}
+		if value := kv.Execute(OpGet, put("a", "")); value != ResultNotFound {
+			t.Fatalf("restore %q kept a=%q", snapshot, value)
+		}
+		if result := kv.Execute(OpPut, put("b", "2")); result != ResultOK {
+			t.Fatalf("put after restoring %q: %q", snapshot, result)
+		}
+	}
+}
+
+func TestKVStoreRestoreInvalid(t *testing.T) {
+	kv := NewKVStore()
+	kv.Execute(OpPut, put("a", "1"))
+	if err := kv.Restore([]byte("not json")); err == nil {
+		t.Fatal("invalid snapshot restored")
+	}
+	if value := kv.Execute(OpGet, put("a", "")); value != "1" {
+		t.Fatalf("failed restore changed a to %q", value)
+	}
+}
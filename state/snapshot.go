@@ -1,18 +1,42 @@
 package state
 
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
 // Snapshot represents the state snapshot of the system.
 type Snapshot struct {
-	// Define the fields for the snapshot here
+	SequenceID int    `json:"sequenceID"` // last request included in the snapshot
+	Data       []byte `json:"data"`       // Application.Snapshot() output
+	Proof      []byte `json:"proof"`      // encoded checkpoint certificate, opaque to this package
 }
 
 // SaveSnapshot saves the current state of the system to a snapshot file.
 func (s *Snapshot) SaveSnapshot(filename string) error {
-	// Implement the logic to save the snapshot to a file
-	return nil
+	bsnap, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash never leaves a truncated snapshot
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, bsnap, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
 
 // LoadSnapshot loads a snapshot from a file and restores the system state.
 func (s *Snapshot) LoadSnapshot(filename string) error {
-	// Implement the logic to load the snapshot from a file and restore the system state
-	return nil
+	bsnap, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bsnap, s)
 }
@@ -1,25 +1,52 @@
 package state
 
-// State represents the current state of the system
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// Application is the replicated service run by every replica.
+// Execute is called once per committed request in sequence number order,
+// so it must be deterministic.
+type Application interface {
+	// Execute applies an operation and returns the result sent back to the client
+	Execute(operation string, message string) string
+	// Snapshot serializes the current state for checkpoints and state transfer
+	Snapshot() ([]byte, error)
+	// Restore replaces the current state with a snapshot
+	Restore(snapshot []byte) error
+}
+
+// State is the default application, it echoes every operation back
+// and only keeps a digest chain of what it executed
 type State struct {
-	// Define your state variables here
+	digest []byte
 }
 
 // NewState creates a new instance of the State struct
 func NewState() *State {
-	// Initialize your state variables here
-	return &State{}
+	return &State{
+		digest: []byte{},
+	}
 }
 
-// AddData adds new data to the state
-func (s *State) AddData(data string) {
-	// Implement the logic to add data to the state
+// Execute echoes the operation
+func (s *State) Execute(operation string, message string) string {
+	hash := sha256.Sum256(append(s.digest, []byte(operation+message)...))
+	s.digest = hash[:]
+	return fmt.Sprintf("operation:%s  message:%s done ", operation, message)
 }
 
-// GetData retrieves data from the state
-func (s *State) GetData() string {
-	// Implement the logic to retrieve data from the state
-	return ""
+// Snapshot returns the digest chain
+func (s *State) Snapshot() ([]byte, error) {
+	snapshot := make([]byte, len(s.digest))
+	copy(snapshot, s.digest)
+	return snapshot, nil
 }
 
-// Add more methods as needed to manipulate the state
+// Restore replaces the digest chain
+func (s *State) Restore(snapshot []byte) error {
+	s.digest = make([]byte, len(snapshot))
+	copy(s.digest, snapshot)
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// a state transfer message together with the way back to the peer that sent it
+type stateTransferPkg struct {
+	msg   []byte
+	reply func([]byte)
+}
+
+// requestStateTransfer asks the peers for the state this replica is missing
+func (node *Node) requestStateTransfer() {
+	node.mutex.Lock()
+	if time.Since(node.lastFetch) < node.timeout {
+		// the previous fetch may still be answered
+		node.mutex.Unlock()
+		return
+	}
+	node.lastFetch = time.Now()
+	fetchMsg := FetchStateMsg{
+		node.lastExecuted,
+		node.nodeID,
+	}
+	node.mutex.Unlock()
+
+	sig, err := node.signMessage(fetchMsg)
+	if err != nil {
+		Logger.Error("Sign fetch state msg failed:%v", err)
+		return
+	}
+	Logger.Infof("Fetching state after sequence %d", fetchMsg.LastExecuted)
+	logBroadcastMsg(hFetchState, fetchMsg)
+	node.hub.broadcastStateTransfer(ComposeMsg(hFetchState, fetchMsg, sig))
+}
+
+func (node *Node) handleStateTransfer(pkg *stateTransferPkg) {
+	header, payload, sig := SplitMsg(pkg.msg)
+	switch header {
+	case hFetchState:
+		node.handleFetchState(payload, sig, pkg.reply)
+	case hState:
+		node.handleState(payload, sig)
+	}
+}
+
+func (node *Node) handleFetchState(payload []byte, sig []byte, reply func([]byte)) {
+	var fetchMsg FetchStateMsg
+	err := json.Unmarshal(payload, &fetchMsg)
+	if err != nil {
+		Logger.Error("Error happened in handle FetchState:%v", err)
+		return
+	}
+	logHandleMsg(hFetchState, fetchMsg, fetchMsg.NodeID)
+	if !node.verifyReplicaMsg(hFetchState, fetchMsg.NodeID, fetchMsg, sig) {
+		return
+	}
+
+	node.mutex.Lock()
+	if fetchMsg.LastExecuted >= node.lastExecuted {
+		// nothing the peer does not already have
+		node.mutex.Unlock()
+		return
+	}
+	stateMsg := StateMsg{
+		node.stableSeqID,
+		node.stableProof,
+		nil,
+		[]CommittedBatch{},
+		node.nodeID,
+	}
+	if fetchMsg.LastExecuted < node.stableSeqID {
+		stateMsg.Snapshot = node.stableSnapshot
+	}
+	for seq := node.stableSeqID + 1; seq <= node.lastExecuted; seq++ {
+		requests := node.batchRequests(node.executedSeqs[seq])
+		if len(requests) == 0 {
+			break
+		}
+		stateMsg.Batches = append(stateMsg.Batches, CommittedBatch{seq, requests})
+	}
+	node.mutex.Unlock()
+
+	msgSig, err := node.signMessage(stateMsg)
+	if err != nil {
+		Logger.Error("Sign state msg failed:%v", err)
+		return
+	}
+	logBroadcastMsg(hState, stateMsg)
+	reply(ComposeMsg(hState, stateMsg, msgSig))
+}
+
+func (node *Node) handleState(payload []byte, sig []byte) {
+	var stateMsg StateMsg
+	err := json.Unmarshal(payload, &stateMsg)
+	if err != nil {
+		Logger.Error("Error happened in handle State:%v", err)
+		return
+	}
+	logHandleMsg(hState, stateMsg, stateMsg.NodeID)
+	if !node.verifyReplicaMsg(hState, stateMsg.NodeID, stateMsg, sig) {
+		return
+	}
+
+	// the snapshot is trusted only if it matches a checkpoint certified by n-f replicas
+	node.mutex.Lock()
+	lastExecuted := node.lastExecuted
+	node.mutex.Unlock()
+	if stateMsg.StableSeqID > lastExecuted && stateMsg.Snapshot != nil {
+		digest, ok := node.verifyCheckpointProof(stateMsg.StableSeqID, stateMsg.CheckpointProof)
+		if !ok || snapshotDigest(stateMsg.Snapshot) != digest {
+			node.rejectReplicaMsg(hState, stateMsg.NodeID, fmt.Sprintf("snapshot of checkpoint %d does not match its certificate", stateMsg.StableSeqID))
+			return
+		}
+		if node.installSnapshot(&stateMsg) {
+			node.persistCheckpoint()
+		}
+	}
+
+	// a batch after the checkpoint is executed once f+1 replicas report it,
+	// at least one of them is correct
+	node.mutex.Lock()
+	// a correct replica executed nothing beyond the watermark window of its checkpoint,
+	// which is not above this replica's execution unless its snapshot was installed
+	limit := stateMsg.StableSeqID
+	if limit > node.lastExecuted {
+		limit = node.lastExecuted
+	}
+	limit += watermarkWindow * node.period
+	for _, committed := range stateMsg.Batches {
+		seq := committed.SequenceID
+		if seq <= node.lastExecuted || seq > limit {
+			continue
+		}
+		digest := batchDigest(committed.Requests)
+		if node.reportedBatch(seq, stateMsg.NodeID) {
+			// one digest per replica and sequence number
+			continue
+		}
+		if node.transferVotes[seq] == nil {
+			node.transferVotes[seq] = make(map[string]map[int]bool)
+		}
+		if node.transferVotes[seq][digest] == nil {
+			node.transferVotes[seq][digest] = make(map[int]bool)
+		}
+		node.transferVotes[seq][digest][stateMsg.NodeID] = true
+		node.transferBatches[digest] = committed.Requests
+	}
+	node.mutex.Unlock()
+	node.executeTransferred()
+}
+
+// reportedBatch tells whether a replica already reported a batch for seq,
+// must be called with node.mutex held
+func (node *Node) reportedBatch(seq int, nodeID int) bool {
+	for _, senders := range node.transferVotes[seq] {
+		if senders[nodeID] {
+			return true
+		}
+	}
+	return false
+}
+
+// installSnapshot jumps to a certified checkpoint, everything at or below it is replaced
+// by the snapshot. It tells whether the snapshot is the one of the stable checkpoint,
+// an older one leaves the stable checkpoint and its proof as they are
+func (node *Node) installSnapshot(stateMsg *StateMsg) bool {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.restoreSnapshot(stateMsg.Snapshot)
+	node.lastExecuted = stateMsg.StableSeqID
+	node.checkpointSnapshots[stateMsg.StableSeqID] = stateMsg.Snapshot
+	if stateMsg.StableSeqID > node.stableSeqID {
+		proof := make([]SignedCheckpointMsg, len(stateMsg.CheckpointProof))
+		copy(proof, stateMsg.CheckpointProof)
+		sort.Slice(proof, func(i, j int) bool {
+			return proof[i].Checkpoint.NodeID < proof[j].Checkpoint.NodeID
+		})
+		node.stableSeqID = stateMsg.StableSeqID
+		node.stableProof = proof
+	}
+	stable := stateMsg.StableSeqID >= node.stableSeqID
+	if stable {
+		node.stableSnapshot = stateMsg.Snapshot
+	}
+	for seq := range node.executedSeqs {
+		if seq <= node.lastExecuted {
+			delete(node.executedSeqs, seq)
+		}
+	}
+	for seq := range node.executionQueue {
+		if seq <= node.lastExecuted {
+			delete(node.executionQueue, seq)
+		}
+	}
+	node.collectGarbage()
+	if node.sequenceID <= node.lastExecuted {
+		node.sequenceID = node.lastExecuted + 1
+	}
+	Logger.Infof("Installed snapshot of checkpoint %d from %d", stateMsg.StableSeqID, stateMsg.NodeID)
+	return stable
+}
+
+// executeTransferred executes the transferred batches that extend the executed prefix
+func (node *Node) executeTransferred() {
+	for {
+		node.mutex.Lock()
+		seq := node.lastExecuted + 1
+		digest := ""
+		for d, senders := range node.transferVotes[seq] {
+			if len(senders) > node.countTolerateFaultNode() {
+				digest = d
+			}
+		}
+		if digest == "" {
+			node.mutex.Unlock()
+			break
+		}
+		node.storeBatch(digest, node.transferBatches[digest])
+		for s := range node.transferVotes {
+			if s <= seq {
+				for d := range node.transferVotes[s] {
+					delete(node.transferBatches, d)
+				}
+				delete(node.transferVotes, s)
+			}
+		}
+		node.mutex.Unlock()
+		node.commit(seq, digest)
+	}
+}
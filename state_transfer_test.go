@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"sr-bft/state"
+)
+
+func transferNode() *Node {
+	return &Node{
+		msgLog:              &MsgLog{},
+		clientTable:         make(map[int]*clientRecord),
+		checkpointSnapshots: make(map[int][]byte),
+		app:                 state.NewKVStore(),
+	}
+}
+
+func checkpointProof(seq int, snapshot []byte) []SignedCheckpointMsg {
+	proof := []SignedCheckpointMsg{}
+	for nodeID := 0; nodeID < 3; nodeID++ {
+		proof = append(proof, SignedCheckpointMsg{CheckpointMsg{seq, snapshotDigest(snapshot), nodeID}, []byte{}})
+	}
+	return proof
+}
+
+// snapshotWith is the snapshot of a replica that executed a put of key
+func snapshotWith(key string) []byte {
+	node := transferNode()
+	node.app.Execute(state.OpPut, state.EncodeKVCommand(state.KVCommand{Key: key, Value: key}))
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.snapshot()
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	snapshot := snapshotWith("a")
+	node := transferNode()
+	node.stableSeqID = -1
+	node.lastExecuted = -1
+	stable := node.installSnapshot(&StateMsg{9, checkpointProof(9, snapshot), snapshot, nil, 1})
+	if !stable || node.stableSeqID != 9 || node.lastExecuted != 9 || !bytes.Equal(node.stableSnapshot, snapshot) {
+		t.Fatalf("stable %v at %d, executed %d", stable, node.stableSeqID, node.lastExecuted)
+	}
+	if len(node.stableProof) != 3 || node.sequenceID != 10 {
+		t.Fatalf("proof of %d checkpoints, next sequence %d", len(node.stableProof), node.sequenceID)
+	}
+}
+
+// a replica whose checkpoint became stable before it executed up to it may still
+// install an older certified snapshot, its stable checkpoint must keep its own snapshot
+func TestInstallOlderSnapshot(t *testing.T) {
+	newer, older := snapshotWith("new"), snapshotWith("old")
+	node := transferNode()
+	node.stableSeqID = 19
+	node.stableProof = checkpointProof(19, newer)
+	node.stableSnapshot = newer
+	node.lastExecuted = 5
+
+	stable := node.installSnapshot(&StateMsg{9, checkpointProof(9, older), older, nil, 1})
+	if stable {
+		t.Fatal("an older snapshot is reported as the stable one")
+	}
+	if node.lastExecuted != 9 {
+		t.Fatalf("executed up to %d, want 9", node.lastExecuted)
+	}
+	if node.stableSeqID != 19 || !bytes.Equal(node.stableSnapshot, newer) {
+		t.Fatalf("stable checkpoint %d with snapshot %s", node.stableSeqID, node.stableSnapshot)
+	}
+	// what handleFetchState serves and persistCheckpoint writes still matches its proof
+	for _, checkpoint := range node.stableProof {
+		if checkpoint.Checkpoint.SequenceID != node.stableSeqID || checkpoint.Checkpoint.Digest != snapshotDigest(node.stableSnapshot) {
+			t.Fatalf("proof %+v does not match the stable snapshot", checkpoint.Checkpoint)
+		}
+	}
+	if got := node.app.Execute(state.OpGet, state.EncodeKVCommand(state.KVCommand{Key: "old"})); got != "old" {
+		t.Fatalf("application not restored from the older snapshot: %q", got)
+	}
+}
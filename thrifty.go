@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+)
+
+// thriftyMode sends prepares and commits only to the fastest replicas that complete a
+// quorum with the sender, 2f+1 replicas without weights, enabled by the thrifty key of
+// system config. The other replicas get the vote when the phase did not complete within
+// thriftyTimeout milliseconds, stragglers left out catch up through state transfer
+func thriftyMode() bool {
+	return SystemConfig["thrifty"] == 1 && !collectorMode()
+}
+
+func thriftyTimeout() time.Duration {
+	timeout := time.Duration(SystemConfig["thriftyTimeout"]) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 50 * time.Millisecond
+	}
+	return timeout
+}
+
+// broadcastVote sends the prepare or commit of this replica for digest,
+// weights are the ones of the batch's pre-prepare
+func (node *Node) broadcastVote(header HeaderMsg, digest string, weights []int, data []byte) {
+	if !thriftyMode() {
+		node.broadcast(data)
+		return
+	}
+	targets := node.hub.fastestPeers(func(peers map[int]bool) bool {
+		return node.quorum.isQuorum(weights, voters(peers, node.nodeID))
+	})
+	node.hub.thriftyBroadcast(targets, data, thriftyTimeout(), func() bool {
+		return node.phaseDone(header, digest, weights)
+	})
+}
+
+// phaseDone tells whether the replica prepared or committed digest, depending on header,
+// a committed batch may still wait for a lower sequence number to execute
+func (node *Node) phaseDone(header HeaderMsg, digest string, weights []int) bool {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if header == hPrepare {
+		return node.msgLog.commitLog[digest][node.nodeID]
+	}
+	return node.quorum.isQuorum(weights, node.msgLog.commitLog[digest])
+}
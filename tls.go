@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	getty "github.com/apache/dubbo-getty"
+)
+
+// system config keys enabling mutual TLS on each port
+const (
+	tlsConsensus     = "tlsConsensus"
+	tlsClient        = "tlsClient"
+	tlsStateTransfer = "tlsStateTransfer"
+)
+
+func tlsEnabled(key string) bool {
+	return SystemConfig[key] == 1
+}
+
+// loadCertificate reads the certificate emitted by the key-gen script next to the key,
+// without one a self-signed certificate is derived from the key
+func loadCertificate(path string, id int, key Signer) (tls.Certificate, error) {
+	certFile := fmt.Sprintf("%s/%d.crt", path, id)
+	if _, err := os.Stat(certFile); err == nil {
+		return tls.LoadX509KeyPair(certFile, fmt.Sprintf("%s/%d.priv", path, id))
+	}
+	if key == nil {
+		return tls.Certificate{}, fmt.Errorf("no key to derive a certificate from")
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(id) + 1),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("%d", id)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer := key.CryptoSigner()
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  signer,
+	}, nil
+}
+
+// pinnedTlsConfigBuilder builds TLS configs that accept a peer by its public key
+// instead of a certificate chain, the keys in config are the trust anchors
+type pinnedTlsConfigBuilder struct {
+	cert    tls.Certificate
+	trusted func(crypto.PublicKey) bool
+}
+
+func (b *pinnedTlsConfigBuilder) BuildTlsConfig() (*tls.Config, error) {
+	return &tls.Config{
+		Certificates: []tls.Certificate{b.cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+		// the chain is checked by verifyPeer
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: b.verifyPeer,
+	}, nil
+}
+
+func (b *pinnedTlsConfigBuilder) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("peer sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if !b.trusted(cert.PublicKey) {
+		return fmt.Errorf("certificate of %s is not bound to a known key", cert.Subject.CommonName)
+	}
+	return nil
+}
+
+func isReplicaKey(pubkey crypto.PublicKey) bool {
+	for _, replica := range Replicas {
+		if replica.pubKey != nil && replica.pubKey.Equal(pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+func isClientKey(pubkey crypto.PublicKey) bool {
+	for _, client := range Clients {
+		if client.pubkey != nil && client.pubkey.Equal(pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionKey returns the key of the certificate the peer of a TLS session presented,
+// nil for sessions without TLS
+func sessionKey(session getty.Session) crypto.PublicKey {
+	conn, ok := session.Conn().(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0].PublicKey
+}
+
+// replicaTlsConfigBuilder is the TLS config of this replica, trusting the given keys
+func (h *NetworkingHub) replicaTlsConfigBuilder(trusted func(crypto.PublicKey) bool) *pinnedTlsConfigBuilder {
+	cert, err := loadCertificate(replicaKeysPath, h.node.nodeID, h.node.privateKey)
+	if err != nil {
+		Logger.Fatalf("Loading TLS certificate failed:%v", err)
+	}
+	return &pinnedTlsConfigBuilder{cert, trusted}
+}
+
+func (h *NetworkingHub) serverOptions(port int, tlsKey string, trusted func(crypto.PublicKey) bool) []getty.ServerOption {
+	options := []getty.ServerOption{getty.WithLocalAddress(fmt.Sprintf(":%d", port))}
+	if tlsEnabled(tlsKey) {
+		options = append(options,
+			getty.WithServerSslEnabled(true),
+			getty.WithServerTlsConfigBuilder(h.replicaTlsConfigBuilder(trusted)),
+		)
+	}
+	return options
+}
+
+func (h *NetworkingHub) clientOptions(address string, tlsKey string) []getty.ClientOption {
+	options := []getty.ClientOption{
+		getty.WithServerAddress(address),
+		getty.WithConnectionNumber(1),
+		getty.WithReconnectInterval(3), //this should be setup in the system config file
+	}
+	if tlsEnabled(tlsKey) {
+		options = append(options,
+			getty.WithClientSslEnabled(true),
+			getty.WithClientTlsConfigBuilder(h.replicaTlsConfigBuilder(isReplicaKey)),
+		)
+	}
+	return options
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// VerificationStats counts the messages rejected per sender, a replica that keeps
+// sending messages which do not verify is likely Byzantine. Clients are counted by
+// address, the client a rejected request claims to come from is not authenticated
+type VerificationStats struct {
+	mu       sync.Mutex
+	replicas map[int]map[HeaderMsg]int
+	clients  map[string]int
+}
+
+func NewVerificationStats() *VerificationStats {
+	return &VerificationStats{
+		replicas: make(map[int]map[HeaderMsg]int),
+		clients:  make(map[string]int),
+	}
+}
+
+func (s *VerificationStats) recordReplica(nodeID int, header HeaderMsg) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replicas[nodeID] == nil {
+		s.replicas[nodeID] = make(map[HeaderMsg]int)
+	}
+	s.replicas[nodeID][header]++
+	total := 0
+	for _, count := range s.replicas[nodeID] {
+		total += count
+	}
+	return total
+}
+
+func (s *VerificationStats) recordClient(addr string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[addr]++
+	return s.clients[addr]
+}
+
+// InvalidFromReplicas returns the number of rejected messages of each replica
+func (s *VerificationStats) InvalidFromReplicas() map[int]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[int]int)
+	for nodeID, counts := range s.replicas {
+		for _, count := range counts {
+			res[nodeID] += count
+		}
+	}
+	return res
+}
+
+// InvalidFromReplica returns the rejected messages of a replica by message type
+func (s *VerificationStats) InvalidFromReplica(nodeID int) map[HeaderMsg]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[HeaderMsg]int)
+	for header, count := range s.replicas[nodeID] {
+		res[header] = count
+	}
+	return res
+}
+
+// InvalidFromClients returns the number of rejected requests of each client address
+func (s *VerificationStats) InvalidFromClients() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]int)
+	for addr, count := range s.clients {
+		res[addr] = count
+	}
+	return res
+}
+
+func (s *VerificationStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sb strings.Builder
+	nodeIDs := []int{}
+	for nodeID := range s.replicas {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Ints(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		fmt.Fprintf(&sb, "replica %d:", nodeID)
+		for header, count := range s.replicas[nodeID] {
+			fmt.Fprintf(&sb, " %s=%d", header, count)
+		}
+		sb.WriteString("\n")
+	}
+	for addr, count := range s.clients {
+		fmt.Fprintf(&sb, "client %s: Request=%d\n", addr, count)
+	}
+	return sb.String()
+}
+
+// verifyReplicaMsg checks that msg was signed, or authenticated, by replica sender
+func (node *Node) verifyReplicaMsg(header HeaderMsg, sender int, msg interface{}, sig []byte) bool {
+	if macEnabled(header) {
+		err := node.verifyAuthenticator(sender, msg, sig)
+		if err != nil {
+			node.rejectReplicaMsg(header, sender, err.Error())
+			return false
+		}
+		return true
+	}
+	pubkey := node.findNodePubkey(sender)
+	if pubkey == nil {
+		node.rejectReplicaMsg(header, sender, "unknown replica")
+		return false
+	}
+	if !verifySignatrue(msg, sig, pubkey) {
+		node.rejectReplicaMsg(header, sender, "invalid signature")
+		return false
+	}
+	return true
+}
+
+// rejectReplicaMsg counts a message from sender that failed verification
+func (node *Node) rejectReplicaMsg(header HeaderMsg, sender int, reason string) {
+	total := node.verifyStats.recordReplica(sender, header)
+	Logger.Warnf("Rejected %s from replica %d: %s (%d rejected so far)", header, sender, reason, total)
+}
+
+// rejectClientRequest counts a request that failed verification against the address
+// it came from, clientID is only the client it claims to come from
+func (node *Node) rejectClientRequest(addr string, clientID int, reason string) {
+	total := node.verifyStats.recordClient(addr)
+	Logger.Warnf("Rejected request of client %d from %s: %s (%d rejected so far)", clientID, addr, reason, total)
+}
+
+// VerificationStats exposes the rejected message counters of this replica
+func (node *Node) VerificationStats() *VerificationStats {
+	return node.verifyStats
+}
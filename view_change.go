@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// operation of the requests filling sequence number gaps in a new view
+const nullOperation = "null"
+
+// startTimer arms the view change timer unless it is already running
+func (node *Node) startTimer() {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.armTimer(node.timeout)
+}
+
+func (node *Node) stopTimer() {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.disarmTimer()
+}
+
+// must be called with node.mutex held
+func (node *Node) armTimer(d time.Duration) {
+	if node.timer != nil {
+		return
+	}
+	node.timerID++
+	timerID := node.timerID
+	node.timer = time.AfterFunc(d, func() {
+		node.timeoutQueue <- timerID
+	})
+}
+
+// must be called with node.mutex held
+func (node *Node) disarmTimer() {
+	if node.timer != nil {
+		node.timer.Stop()
+		node.timer = nil
+	}
+}
+
+// handleTimeout moves to the next view when the primary failed to make progress in time
+func (node *Node) handleTimeout(timerID int) {
+	node.mutex.Lock()
+	if node.timer == nil || timerID != node.timerID {
+		// the timer was stopped after it fired
+		node.mutex.Unlock()
+		return
+	}
+	node.timer = nil
+	if hotstuffMode() {
+		node.mutex.Unlock()
+		node.hotstuff.localTimeout()
+		return
+	}
+	view := node.View
+	nextView := node.nextView(view)
+	node.mutex.Unlock()
+	Logger.Warnf("Timer expired in view %d, moving to view %d", view, nextView)
+	node.startViewChange(nextView)
+}
+
+func (node *Node) hasPendingRequests() bool {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	for _, request := range node.requestPool {
+		if !node.executed(&request.Request) {
+			return true
+		}
+	}
+	return false
+}
+
+// startViewChange stops normal operation and broadcasts a view change to newView
+func (node *Node) startViewChange(newView int) {
+	node.mutex.Lock()
+	if newView <= node.View {
+		node.mutex.Unlock()
+		return
+	}
+	node.View = newView
+	node.viewChanging = true
+	node.disarmTimer()
+	// if the new primary does not install the view in time, try the next one
+	node.armTimer(node.viewChangeTimeout)
+	node.viewChangeTimeout *= 2
+	// the next primary proposes from its own request pool
+	node.proposalQueue = nil
+	node.takeBatch()
+	viewChangeMsg := ViewChangeMsg{
+		newView,
+		node.stableSeqID,
+		node.stableProof,
+		node.collectPreparedCerts(),
+		node.collectPrePrepared(),
+		node.nodeID,
+	}
+	node.mutex.Unlock()
+
+	sig, err := node.signMessage(viewChangeMsg)
+	if err != nil {
+		Logger.Error("Sign view change msg failed:%v", err)
+		return
+	}
+	node.mutex.Lock()
+	node.logViewChange(&SignedViewChangeMsg{viewChangeMsg, sig})
+	node.mutex.Unlock()
+	Logger.Infof("Starting view change to view %d", newView)
+	logBroadcastMsg(hViewChange, viewChangeMsg)
+	node.broadcast(ComposeMsg(hViewChange, viewChangeMsg, sig))
+	node.tryNewView(newView)
+}
+
+// must be called with node.mutex held
+func (node *Node) collectPreparedCerts() []PreparedCert {
+	certs := []PreparedCert{}
+	for digest, prePrepare := range node.msgLog.prePrepareMsgs {
+		if prePrepare.PrePrepare.SequenceID <= node.stableSeqID {
+			continue
+		}
+		prepares := []SignedPrepareMsg{}
+		senders := map[int]bool{node.primaryOf(prePrepare.PrePrepare.ViewID): true}
+		for _, prepare := range node.msgLog.prepareMsgs[digest] {
+			if prepare.Prepare.ViewID == prePrepare.PrePrepare.ViewID &&
+				prepare.Prepare.SequenceID == prePrepare.PrePrepare.SequenceID {
+				prepares = append(prepares, *prepare)
+				senders[prepare.Prepare.NodeID] = true
+			}
+		}
+		if !node.quorum.isQuorum(prePrepare.PrePrepare.Weights, senders) {
+			continue
+		}
+		sort.Slice(prepares, func(i, j int) bool {
+			return prepares[i].Prepare.NodeID < prepares[j].Prepare.NodeID
+		})
+		certs = append(certs, PreparedCert{*prePrepare, prepares})
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].PrePrepare.PrePrepare.SequenceID < certs[j].PrePrepare.PrePrepare.SequenceID
+	})
+	return certs
+}
+
+// must be called with node.mutex held
+func (node *Node) logViewChange(msg *SignedViewChangeMsg) {
+	view := msg.ViewChange.ViewID
+	if node.msgLog.viewChangeLog[view] == nil {
+		node.msgLog.viewChangeLog[view] = make(map[int]*SignedViewChangeMsg)
+	}
+	node.msgLog.viewChangeLog[view][msg.ViewChange.NodeID] = msg
+}
+
+func (node *Node) handleViewChange(payload []byte, sig []byte) {
+	var viewChangeMsg ViewChangeMsg
+	err := json.Unmarshal(payload, &viewChangeMsg)
+	if err != nil {
+		Logger.Error("Error happened in handle ViewChange:%v", err)
+		return
+	}
+	logHandleMsg(hViewChange, viewChangeMsg, viewChangeMsg.NodeID)
+	signed := &SignedViewChangeMsg{viewChangeMsg, sig}
+
+	node.mutex.Lock()
+	if viewChangeMsg.ViewID < node.View || (viewChangeMsg.ViewID == node.View && !node.viewChanging) {
+		node.mutex.Unlock()
+		return
+	}
+	node.logViewChange(signed)
+	// f+1 replicas moving past our view means at least one correct replica timed out,
+	// join the smallest of those views
+	joinView := -1
+	senders := make(map[int]bool)
+	for view, msgs := range node.msgLog.viewChangeLog {
+		if view <= node.View {
+			continue
+		}
+		for sender := range msgs {
+			senders[sender] = true
+		}
+		if joinView < 0 || view < joinView {
+			joinView = view
+		}
+	}
+	node.mutex.Unlock()
+
+	if len(senders) > node.countTolerateFaultNode() {
+		node.startViewChange(joinView)
+	}
+	node.tryNewView(viewChangeMsg.ViewID)
+}
+
+// tryNewView broadcasts the new view once the new primary holds n-f view changes
+func (node *Node) tryNewView(view int) {
+	node.mutex.Lock()
+	if view != node.View || !node.viewChanging || node.primaryOf(view) != node.nodeID {
+		node.mutex.Unlock()
+		return
+	}
+	if len(node.msgLog.viewChangeLog[view]) < node.countNeedReceiveMsgAmount() {
+		node.mutex.Unlock()
+		return
+	}
+	viewChanges := []SignedViewChangeMsg{}
+	for _, msg := range node.msgLog.viewChangeLog[view] {
+		viewChanges = append(viewChanges, *msg)
+	}
+	node.mutex.Unlock()
+	sort.Slice(viewChanges, func(i, j int) bool {
+		return viewChanges[i].ViewChange.NodeID < viewChanges[j].ViewChange.NodeID
+	})
+	viewChanges = viewChanges[:node.countNeedReceiveMsgAmount()]
+
+	prePrepares := []SignedPrePrepareMsg{}
+	for _, prePrepareMsg := range computeNewViewPrePrepares(view, viewChanges, node.countTolerateFaultNode()) {
+		sig, err := node.signMessage(prePrepareMsg)
+		if err != nil {
+			Logger.Error("Sign prePrepareMsg failed in new view:%v", err)
+			return
+		}
+		prePrepares = append(prePrepares, SignedPrePrepareMsg{prePrepareMsg, sig})
+	}
+	newViewMsg := NewViewMsg{
+		view,
+		viewChanges,
+		prePrepares,
+		node.nodeID,
+	}
+	sig, err := node.signMessage(newViewMsg)
+	if err != nil {
+		Logger.Error("Sign new view msg failed:%v", err)
+		return
+	}
+	logBroadcastMsg(hNewView, newViewMsg)
+	node.broadcast(ComposeMsg(hNewView, newViewMsg, sig))
+	node.installNewView(&newViewMsg)
+}
+
+func (node *Node) handleNewView(payload []byte, sig []byte) {
+	var newViewMsg NewViewMsg
+	err := json.Unmarshal(payload, &newViewMsg)
+	if err != nil {
+		Logger.Error("Error happened in handle NewView:%v", err)
+		return
+	}
+	logHandleMsg(hNewView, newViewMsg, newViewMsg.NodeID)
+	node.mutex.Lock()
+	stale := newViewMsg.ViewID < node.View || (newViewMsg.ViewID == node.View && !node.viewChanging)
+	node.mutex.Unlock()
+	if stale {
+		return
+	}
+	node.installNewView(&newViewMsg)
+}
+
+// verifyNewView checks a new view against the view changes it carries
+func (node *Node) verifyNewView(newViewMsg *NewViewMsg, sig []byte) bool {
+	// only the primary of the new view may send it
+	if newViewMsg.NodeID != node.primaryOf(newViewMsg.ViewID) {
+		node.rejectReplicaMsg(hNewView, newViewMsg.NodeID, fmt.Sprintf("not the primary of view %d", newViewMsg.ViewID))
+		return false
+	}
+	if !node.verifyReplicaMsg(hNewView, newViewMsg.NodeID, *newViewMsg, sig) {
+		return false
+	}
+	pubkey := node.findNodePubkey(newViewMsg.NodeID)
+
+	// verify V: n-f valid view changes for this view from distinct replicas
+	senders := make(map[int]bool)
+	for i := range newViewMsg.ViewChanges {
+		viewChange := &newViewMsg.ViewChanges[i]
+		if viewChange.ViewChange.ViewID != newViewMsg.ViewID || !node.verifyViewChange(viewChange) {
+			node.rejectReplicaMsg(hNewView, newViewMsg.NodeID, "invalid view change")
+			return false
+		}
+		senders[viewChange.ViewChange.NodeID] = true
+	}
+	if len(senders) < node.countNeedReceiveMsgAmount() {
+		node.rejectReplicaMsg(hNewView, newViewMsg.NodeID, "not enough view changes")
+		return false
+	}
+
+	// verify O: the pre-prepares must be the ones computed from V
+	expected := computeNewViewPrePrepares(newViewMsg.ViewID, newViewMsg.ViewChanges, node.countTolerateFaultNode())
+	if len(expected) != len(newViewMsg.PrePrepares) {
+		node.rejectReplicaMsg(hNewView, newViewMsg.NodeID, "unexpected pre-prepares")
+		return false
+	}
+	for i, prePrepare := range newViewMsg.PrePrepares {
+		if !samePrePrepare(&prePrepare.PrePrepare, &expected[i]) || !verifySignatrue(prePrepare.PrePrepare, prePrepare.Signature, pubkey) {
+			node.rejectReplicaMsg(hNewView, newViewMsg.NodeID, fmt.Sprintf("unexpected pre-prepare for sequence %d", expected[i].SequenceID))
+			return false
+		}
+	}
+	return true
+}
+
+// installNewView enters the new view and processes the re-proposed pre-prepares
+func (node *Node) installNewView(newViewMsg *NewViewMsg) {
+	node.mutex.Lock()
+	node.View = newViewMsg.ViewID
+	node.viewChanging = false
+	node.viewChangeTimeout = node.timeout
+	node.disarmTimer()
+	for view := range node.msgLog.viewChangeLog {
+		if view <= node.View {
+			delete(node.msgLog.viewChangeLog, view)
+		}
+	}
+	minS := -1
+	for _, viewChange := range newViewMsg.ViewChanges {
+		if viewChange.ViewChange.StableSeqID > minS {
+			minS = viewChange.ViewChange.StableSeqID
+		}
+	}
+	if minS >= node.sequenceID {
+		node.sequenceID = minS + 1
+	}
+	lagging := minS > node.lastExecuted
+	reproposed := make(map[string]bool)
+	for _, prePrepare := range newViewMsg.PrePrepares {
+		digest := prePrepare.PrePrepare.Digest
+		for _, request := range prePrepare.PrePrepare.Requests {
+			reproposed[requestKey(&request.Request)] = true
+		}
+		// votes from older views do not count in this one
+		delete(node.msgLog.preprepareLog, digest)
+		delete(node.msgLog.prepareLog, digest)
+		delete(node.msgLog.commitLog, digest)
+		delete(node.msgLog.prePrepareMsgs, digest)
+		delete(node.msgLog.prepareMsgs, digest)
+		delete(node.msgLog.commitMsgs, digest)
+		delete(node.msgLog.commitCerts, digest)
+		delete(node.msgLog.fastCommits, digest)
+		if prePrepare.PrePrepare.SequenceID >= node.sequenceID {
+			node.sequenceID = prePrepare.PrePrepare.SequenceID + 1
+		}
+	}
+	isPrimary := node.findPrimaryNode() == node.nodeID
+	pending := []SignedRequestMsg{}
+	for key, request := range node.requestPool {
+		if !node.executed(&request.Request) && !reproposed[key] {
+			pending = append(pending, *request)
+		}
+	}
+	// a client request older than one already executed would be dropped
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Request.Timestamp < pending[j].Request.Timestamp
+	})
+	deferred := node.takeDeferred()
+	node.mutex.Unlock()
+	Logger.Infof("Entered view %d, primary is %d", newViewMsg.ViewID, node.findPrimaryNode())
+	if lagging {
+		Logger.Warnf("New view starts after checkpoint %d, fetching the missing state", minS)
+		node.requestStateTransfer()
+	}
+
+	if isPrimary {
+		for _, prePrepare := range newViewMsg.PrePrepares {
+			node.mutex.Lock()
+			node.storeBatch(prePrepare.PrePrepare.Digest, prePrepare.PrePrepare.Requests)
+			node.logPrePrepare(prePrepare.PrePrepare, prePrepare.Signature)
+			node.mutex.Unlock()
+		}
+		// requests the old primary never ordered, by timestamp
+		for _, request := range pending {
+			node.addToBatch(request)
+		}
+		node.flushBatch()
+	} else {
+		for _, prePrepare := range newViewMsg.PrePrepares {
+			node.acceptPrePrepare(prePrepare.PrePrepare, prePrepare.Signature)
+		}
+		if node.hasPendingRequests() {
+			node.startTimer()
+		}
+	}
+
+	for _, msg := range deferred {
+		node.dispatch(msg.header, msg.payload, msg.sig)
+	}
+}
+
+// the order of the phases of an agreement, deferred messages are replayed in it
+var phaseOrder = map[HeaderMsg]int{
+	hPrePrepare:  0,
+	hPrepare:     1,
+	hPrepareCert: 2,
+	hCommit:      3,
+	hCommitCert:  4,
+}
+
+// takeDeferred returns the deferred messages of the current view by sequence number and
+// phase, and drops those of the views already passed, must be called with node.mutex held
+func (node *Node) takeDeferred() []*deferredMsg {
+	ready := []*deferredMsg{}
+	for key, msg := range node.deferredMsgs {
+		if key.view > node.View {
+			continue
+		}
+		if key.view == node.View {
+			ready = append(ready, msg)
+		}
+		delete(node.deferredMsgs, key)
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		if ready[i].seq != ready[j].seq {
+			return ready[i].seq < ready[j].seq
+		}
+		return phaseOrder[ready[i].header] < phaseOrder[ready[j].header]
+	})
+	return ready
+}
+
+// computeNewViewPrePrepares derives the pre-prepares of a new view from its view changes,
+// every replica must reach the same result from the same view changes. A batch accepted
+// by f+1 replicas in a later view than every prepared certificate may have committed on
+// the fast path and takes precedence
+func computeNewViewPrePrepares(view int, viewChanges []SignedViewChangeMsg, f int) []PrePrepareMsg {
+	minS := -1
+	for _, viewChange := range viewChanges {
+		if viewChange.ViewChange.StableSeqID > minS {
+			minS = viewChange.ViewChange.StableSeqID
+		}
+	}
+	maxS := minS
+	prepared := make(map[int]*PrePrepareMsg)
+	for _, viewChange := range viewChanges {
+		for i := range viewChange.ViewChange.PreparedCerts {
+			prePrepare := &viewChange.ViewChange.PreparedCerts[i].PrePrepare.PrePrepare
+			if prePrepare.SequenceID <= minS {
+				continue
+			}
+			if prev, ok := prepared[prePrepare.SequenceID]; !ok || prePrepare.ViewID > prev.ViewID {
+				prepared[prePrepare.SequenceID] = prePrepare
+			}
+			if prePrepare.SequenceID > maxS {
+				maxS = prePrepare.SequenceID
+			}
+		}
+	}
+	accepted := acceptedPrePrepares(viewChanges, minS, f)
+	for seq := range accepted {
+		if seq > maxS {
+			maxS = seq
+		}
+	}
+
+	prePrepares := []PrePrepareMsg{}
+	for seq := minS + 1; seq <= maxS; seq++ {
+		batch := []SignedRequestMsg{{newNullRequest(view, seq), []byte{}}}
+		prePrepare, ok := prepared[seq]
+		if ok {
+			batch = prePrepare.Requests
+		}
+		if fast, ok := accepted[seq]; ok && (prePrepare == nil || fast.view > prePrepare.ViewID) {
+			batch = fast.prePrepare.Requests
+		}
+		// every replica entering the view agrees on the base weights
+		prePrepares = append(prePrepares, PrePrepareMsg{
+			batch,
+			batchDigest(batch),
+			view,
+			seq,
+			nil,
+		})
+	}
+	return prePrepares
+}
+
+// samePrePrepare compares pre-prepares by their ordering fields,
+// the digest covers the whole batch
+func samePrePrepare(a *PrePrepareMsg, b *PrePrepareMsg) bool {
+	return a.Digest == b.Digest && a.ViewID == b.ViewID && a.SequenceID == b.SequenceID &&
+		a.Weights == nil && b.Weights == nil && batchDigest(a.Requests) == a.Digest
+}
+
+// verifyViewChange checks the sender's signature and every prepared certificate
+func (node *Node) verifyViewChange(msg *SignedViewChangeMsg) bool {
+	pubkey := node.findNodePubkey(msg.ViewChange.NodeID)
+	if pubkey == nil || !verifySignatrue(msg.ViewChange, msg.Signature, pubkey) {
+		return false
+	}
+	if msg.ViewChange.StableSeqID >= 0 {
+		if _, ok := node.verifyCheckpointProof(msg.ViewChange.StableSeqID, msg.ViewChange.CheckpointProof); !ok {
+			return false
+		}
+	}
+	for i := range msg.ViewChange.PreparedCerts {
+		if !node.verifyPreparedCert(&msg.ViewChange.PreparedCerts[i]) {
+			return false
+		}
+	}
+	// a replica reports a single accepted pre-prepare per sequence number
+	reported := make(map[int]bool)
+	for _, prePrepare := range msg.ViewChange.PrePrepared {
+		seq := prePrepare.PrePrepare.SequenceID
+		if reported[seq] || prePrepare.PrePrepare.ViewID >= msg.ViewChange.ViewID {
+			return false
+		}
+		reported[seq] = true
+		pubkey := node.findNodePubkey(node.primaryOf(prePrepare.PrePrepare.ViewID))
+		if pubkey == nil || !verifySignatrue(prePrepare.PrePrepare, prePrepare.Signature, pubkey) {
+			return false
+		}
+		if node.verifyBatch(prePrepare.PrePrepare.Digest, prePrepare.PrePrepare.Requests) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyPreparedCert checks a pre-prepare signed by its primary and matching prepares that hold a quorum
+func (node *Node) verifyPreparedCert(cert *PreparedCert) bool {
+	prePrepare := cert.PrePrepare.PrePrepare
+	primary := node.primaryOf(prePrepare.ViewID)
+	pubkey := node.findNodePubkey(primary)
+	if pubkey == nil || !verifySignatrue(prePrepare, cert.PrePrepare.Signature, pubkey) {
+		return false
+	}
+	if node.verifyBatch(prePrepare.Digest, prePrepare.Requests) != nil {
+		return false
+	}
+	// any assignment of the base weights keeps a quorum out of reach of the faulty replicas
+	if !node.quorum.validAssignment(prePrepare.Weights) {
+		return false
+	}
+	senders := map[int]bool{primary: true}
+	for _, prepare := range cert.Prepares {
+		msg := prepare.Prepare
+		if msg.Digest != prePrepare.Digest || msg.ViewID != prePrepare.ViewID ||
+			msg.SequenceID != prePrepare.SequenceID || msg.NodeID == primary {
+			return false
+		}
+		pubkey := node.findNodePubkey(msg.NodeID)
+		if pubkey == nil || !verifySignatrue(msg, prepare.Signature, pubkey) {
+			return false
+		}
+		senders[msg.NodeID] = true
+	}
+	return node.quorum.isQuorum(prePrepare.Weights, senders)
+}
+
+// newNullRequest builds the no-op request proposed for a sequence number nobody prepared
+func newNullRequest(view int, seq int) RequestMsg {
+	msg := fmt.Sprintf("null-%d-%d", view, seq)
+	return RequestMsg{
+		nullOperation,
+		0,
+		-1,
+		Request{
+			msg,
+			hex.EncodeToString(generateDigest(msg)),
+		},
+	}
+}
+
+func isNullRequest(request *RequestMsg) bool {
+	return request.Operation == nullOperation && request.ClientID < 0
+}